@@ -0,0 +1,100 @@
+package socketman
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+var (
+	activationOnce      sync.Once
+	activationListeners map[string][]net.Listener
+	activationErr       error
+)
+
+//ActivationListeners returns the listeners passed by systemd
+//socket activation, indexed by name.
+//
+//Names are set with FileDescriptorName= in the socket unit and
+//passed through LISTEN_FDNAMES; unnamed sockets are called
+//"unknown", like systemd does.
+//The environment is only read once and LISTEN_PID, LISTEN_FDS and
+//LISTEN_FDNAMES are then unset so child processes don't pick them up.
+//
+//Returned listeners can be served with Server.Serve.
+//An empty map is returned if the process was not socket activated.
+func ActivationListeners() (map[string][]net.Listener, error) {
+	activationOnce.Do(func() {
+		activationListeners, activationErr = activationFromEnv()
+	})
+	return activationListeners, activationErr
+}
+
+//ActivationListener returns the first listener passed by systemd
+//socket activation under name. See ActivationListeners.
+func ActivationListener(name string) (net.Listener, error) {
+	listeners, err := ActivationListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners[name]) == 0 {
+		return nil, fmt.Errorf("socketman: no activation listener named %q", name)
+	}
+	return listeners[name][0], nil
+}
+
+func activationFromEnv() (map[string][]net.Listener, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid == "" || fds == "" {
+		return map[string][]net.Listener{}, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		// fds were meant for another process
+		return map[string][]net.Listener{}, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("socketman: invalid LISTEN_FDS %q", fds)
+	}
+	return inheritListeners(listenFdsStart, n, strings.Split(names, ":"))
+}
+
+//inheritListeners turns the n file descriptors starting at start
+//into listeners. names are applied in order if there is one for
+//each file descriptor.
+func inheritListeners(start, n int, names []string) (map[string][]net.Listener, error) {
+	if len(names) != n {
+		names = nil
+	}
+	listeners := map[string][]net.Listener{}
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if names != nil && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(start+i), name)
+		// FileListener dups the fd, with close on exec set.
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ls := range listeners {
+				for _, l := range ls {
+					l.Close()
+				}
+			}
+			return nil, fmt.Errorf("socketman: file descriptor %d (%s): %s", start+i, name, err)
+		}
+		listeners[name] = append(listeners[name], l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,111 @@
+package socketman_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/azr/socketman"
+)
+
+// TestActivationHelper is not a real test: it's the socket activated
+// process spawned by TestActivation.
+func TestActivationHelper(t *testing.T) {
+	if os.Getenv("SOCKETMAN_ACTIVATION_HELPER") != "1" {
+		t.Skip("helper process")
+	}
+	listeners, err := socketman.ActivationListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("activation environment should have been unset")
+	}
+	echo, err := socketman.ActivationListener("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upper, err := socketman.ActivationListener("upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("expected two named listeners, got %v", listeners)
+	}
+
+	s := &socketman.Server{}
+	go s.Serve(echo, socketman.HandlerFunc(echoHandler))
+	s.Serve(upper, socketman.HandlerFunc(func(c io.ReadWriter) {
+		b := make([]byte, 512)
+		n, _ := c.Read(b)
+		c.Write(bytes.ToUpper(b[:n]))
+	}))
+}
+
+func TestActivation(t *testing.T) {
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	// like systemd, LISTEN_PID is set to the pid of the activated process.
+	cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ exec "$0" "$@"`, os.Args[0], "-test.run=^TestActivationHelper$")
+	cmd.Env = append(os.Environ(),
+		"SOCKETMAN_ACTIVATION_HELPER=1",
+		"LISTEN_FDS=2",
+		"LISTEN_FDNAMES=echo:upper",
+	)
+	cmd.ExtraFiles = files
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	for i, expected := range []string{"hello, world!", "HELLO, WORLD!"} {
+		out := make([]byte, len(expected))
+		client := &socketman.Client{}
+		err := client.ConnectFunc(addrs[i], func(c io.ReadWriter) {
+			io.WriteString(c, "hello, world!")
+			if _, err := io.ReadFull(c, out); err != nil {
+				t.Errorf("read failed: %s", err)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expected {
+			t.Errorf("expected %q from %s, got %q", expected, addrs[i], out)
+		}
+	}
+}
+
+func TestActivation_notActivated(t *testing.T) {
+	if os.Getenv("SOCKETMAN_ACTIVATION_HELPER") == "1" {
+		t.Skip("helper process")
+	}
+	_, err := socketman.ActivationListener("echo")
+	if err == nil || !strings.Contains(err.Error(), "echo") {
+		t.Fatalf("expected a missing listener error, got %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package socketman
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//DefaultReloadInterval is the Interval of a CertReloader
+//when zero.
+const DefaultReloadInterval = 10 * time.Second
+
+//CertReloader serves a certificate, and optionally a CA bundle
+//verifying clients, from PEM files it reloads when they change,
+//so certificates can be rotated without restarting servers.
+//
+//A failed reload is reported and the previous certificate
+//keeps being served.
+//
+//	r := &socketman.CertReloader{CertFile: "cert.pem", KeyFile: "key.pem"}
+//	if err := r.Start(); err != nil {
+//		...
+//	}
+//	defer r.Close()
+//	server.Config.TLSConfig = r.TLSConfig()
+type CertReloader struct {
+	CertFile, KeyFile string
+
+	//ClientCAFile, if set, is a PEM bundle of CAs
+	//verifying client certificates: ClientCAs.
+	ClientCAFile string
+
+	//Base, if set, holds the other TLS settings,
+	//like ClientAuth or MinVersion.
+	Base *tls.Config
+
+	//Interval is how often files are checked for changes.
+	//Zero means DefaultReloadInterval.
+	Interval time.Duration
+
+	//OnError, if set, is called with reload errors,
+	//which are logged otherwise.
+	OnError func(error)
+
+	current atomic.Value // *tls.Config
+
+	mu     sync.Mutex // serializes reloads, guards stamps
+	stamps []fileStamp
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+//fileStamp tells whether a file changed.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+//Start loads the files, failing if they are invalid,
+//and watches them until Close.
+func (r *CertReloader) Start() error {
+	if err := r.Reload(); err != nil {
+		return err
+	}
+	r.stop = make(chan struct{})
+	interval := r.Interval
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	go r.watch(interval)
+	return nil
+}
+
+//Close stops watching files.
+func (r *CertReloader) Close() error {
+	r.stopOnce.Do(func() {
+		if r.stop != nil {
+			close(r.stop)
+		}
+	})
+	return nil
+}
+
+func (r *CertReloader) watch(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+		}
+		if !r.changed() {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			if r.OnError != nil {
+				r.OnError(err)
+			} else {
+				log.Printf("socketman: certificate reload failed: %s", err)
+			}
+		}
+	}
+}
+
+func (r *CertReloader) files() []string {
+	files := []string{r.CertFile, r.KeyFile}
+	if r.ClientCAFile != "" {
+		files = append(files, r.ClientCAFile)
+	}
+	return files
+}
+
+//stat returns stamps of the files; unreadable files
+//get zero stamps.
+func (r *CertReloader) stat() []fileStamp {
+	var stamps []fileStamp
+	for _, f := range r.files() {
+		var stamp fileStamp
+		if fi, err := os.Stat(f); err == nil {
+			stamp = fileStamp{fi.ModTime(), fi.Size()}
+		}
+		stamps = append(stamps, stamp)
+	}
+	return stamps
+}
+
+func (r *CertReloader) changed() bool {
+	stamps := r.stat()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range stamps {
+		if i >= len(r.stamps) || stamps[i] != r.stamps[i] {
+			return true
+		}
+	}
+	return false
+}
+
+//Reload loads the files now. On error, the previous
+//certificate is kept.
+func (r *CertReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// stat first: files written while loading
+	// are seen as changed next time.
+	r.stamps = r.stat()
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{}
+	if r.Base != nil {
+		config = r.Base.Clone()
+	}
+	config.Certificates = []tls.Certificate{cert}
+	config.GetCertificate = nil
+	config.GetConfigForClient = nil
+	if r.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("socketman: no certificate found in " + r.ClientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+	r.current.Store(config)
+	return nil
+}
+
+//Config returns the TLS config of the
+//files last loaded successfully.
+func (r *CertReloader) Config() *tls.Config {
+	config, _ := r.current.Load().(*tls.Config)
+	return config
+}
+
+//GetCertificate returns the current certificate;
+//it's a tls.Config GetCertificate callback.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	config := r.Config()
+	if config == nil {
+		return nil, errors.New("socketman: CertReloader not started")
+	}
+	return &config.Certificates[0], nil
+}
+
+//GetConfigForClient returns the current config;
+//it's a tls.Config GetConfigForClient callback.
+func (r *CertReloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	config := r.Config()
+	if config == nil {
+		return nil, errors.New("socketman: CertReloader not started")
+	}
+	return config, nil
+}
+
+//TLSConfig returns a config serving the current files, for
+//Config.TLSConfig or a VirtualHost.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate:     r.GetCertificate,
+		GetConfigForClient: r.GetConfigForClient,
+	}
+}
@@ -0,0 +1,141 @@
+package socketman_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+)
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeCert(t *testing.T, dir string, cert tls.Certificate) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "cert.pem"), "CERTIFICATE", cert.Certificate[0])
+	writePEM(t, filepath.Join(dir, "key.pem"), "PRIVATE KEY", key)
+}
+
+// waitReload waits for r to load another config than old.
+func waitReload(t *testing.T, r *socketman.CertReloader, old *tls.Config) {
+	for deadline := time.Now().Add(time.Second); r.Config() == old; {
+		if time.Now().After(deadline) {
+			t.Fatal("files were not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// connects tells whether client is served.
+func connects(client *socketman.Client) bool {
+	var answer []byte
+	client.ConnectFunc(addr, func(c io.ReadWriter) {
+		answer, _ = io.ReadAll(c)
+	})
+	return string(answer) == "ok:"
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	first, second := selfSigned(t, "one.example.com"), selfSigned(t, "two.example.com")
+	writeCert(t, dir, first)
+
+	errs := make(chan error, 10)
+	r := &socketman.CertReloader{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+		Interval: 10 * time.Millisecond,
+		OnError:  func(err error) { errs <- err },
+	}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer serve(t, &socketman.Server{Config: socketman.Config{TLSConfig: r.TLSConfig()}}, named("ok", 0))()
+
+	if !connects(vhostClient("one.example.com", &first)) {
+		t.Fatal("first certificate should be served")
+	}
+
+	old := r.Config()
+	writeCert(t, dir, second)
+	waitReload(t, r, old)
+	if !connects(vhostClient("two.example.com", &second)) {
+		t.Fatal("second certificate should be served after a reload")
+	}
+
+	// a broken key is reported, the second
+	// certificate keeps being served.
+	for len(errs) > 0 {
+		<-errs // key and certificate written apart
+	}
+	os.WriteFile(filepath.Join(dir, "key.pem"), []byte("garbage"), 0600)
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("reload error should be reported")
+	}
+	if !connects(vhostClient("two.example.com", &second)) {
+		t.Fatal("previous certificate should be kept on reload errors")
+	}
+}
+
+func TestCertReloader_clientCAs(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, selfSigned(t, "server.example.com"))
+	alice, bob := selfSigned(t, "alice"), selfSigned(t, "bob")
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", alice.Certificate[0])
+
+	r := &socketman.CertReloader{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		ClientCAFile: caFile,
+		Base:         &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert},
+		Interval:     10 * time.Millisecond,
+	}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer serve(t, &socketman.Server{Config: socketman.Config{TLSConfig: r.TLSConfig()}}, named("ok", 0))()
+
+	client := func(cert tls.Certificate) *socketman.Client {
+		c := vhostClient("server.example.com", nil)
+		c.Config.TLSConfig.Certificates = []tls.Certificate{cert}
+		return c
+	}
+	if !connects(client(alice)) || connects(client(bob)) {
+		t.Fatal("only alice should be trusted")
+	}
+
+	old := r.Config()
+	writePEM(t, caFile, "CERTIFICATE", bob.Certificate[0])
+	waitReload(t, r, old)
+	if connects(client(alice)) || !connects(client(bob)) {
+		t.Fatal("only bob should be trusted after a reload")
+	}
+}
+
+func TestCertReloader_start(t *testing.T) {
+	dir := t.TempDir()
+	r := &socketman.CertReloader{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}
+	if err := r.Start(); err == nil {
+		t.Fatal("starting without certificate should fail")
+	}
+}
@@ -0,0 +1,178 @@
+package socketman
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//Compressor is a stream compression algorithm, like
+//DeflateCompressor. Others, like zstd or snappy, can be
+//plugged in by implementing it.
+type Compressor interface {
+	//Name identifies the algorithm when negotiating it,
+	//like "deflate". It's at most 255 bytes long.
+	Name() string
+
+	//Writer returns a writer compressing to w. Its error,
+	//like an invalid setting, fails the connection.
+	Writer(w io.Writer) (CompressWriter, error)
+
+	//Reader returns a reader decompressing from r.
+	Reader(r io.Reader) io.Reader
+}
+
+//CompressWriter is a compressing writer.
+type CompressWriter interface {
+	io.Writer
+
+	//Flush writes any pending data to the underlying
+	//writer, so the peer can read it all.
+	Flush() error
+}
+
+//DeflateCompressor compresses with DEFLATE (RFC 1951).
+type DeflateCompressor struct {
+	//Level is the compress/flate compression level.
+	//Zero means flate.DefaultCompression.
+	Level int
+}
+
+//Name returns "deflate".
+func (d DeflateCompressor) Name() string { return "deflate" }
+
+//Writer returns a flate writer, failing
+//if Level is invalid.
+func (d DeflateCompressor) Writer(w io.Writer) (CompressWriter, error) {
+	level := d.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	fw, err := flate.NewWriter(w, level)
+	if err != nil {
+		return nil, fmt.Errorf("socketman: deflate: %w", err)
+	}
+	return fw, nil
+}
+
+//Reader returns a flate reader.
+func (d DeflateCompressor) Reader(r io.Reader) io.Reader {
+	return flate.NewReader(r)
+}
+
+//compressWriter flushes after each Write,
+//so every Write reaches the peer.
+type compressWriter struct {
+	cw CompressWriter
+}
+
+func (w compressWriter) Write(p []byte) (int, error) {
+	n, err := w.cw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.cw.Flush()
+}
+
+//compress wraps c's streams with comp, above cypher streams
+//so compressed data gets encrypted.
+func (c *conn) compress(comp Compressor) error {
+	if comp == nil {
+		return nil
+	}
+	cw, err := comp.Writer(c.w)
+	if err != nil {
+		return err
+	}
+	c.r = comp.Reader(c.r)
+	c.w = compressWriter{cw}
+	c.compressed = true
+	return nil
+}
+
+var errBadCompression = errors.New("socketman: invalid compression negotiation")
+
+//offerCompression sends the names of compressors to the server
+//and returns the one it picked, if any.
+func offerCompression(rw io.ReadWriter, compressors []Compressor) (Compressor, error) {
+	if len(compressors) == 0 {
+		return nil, nil
+	}
+	if len(compressors) > 255 {
+		return nil, errors.New("socketman: too many compressors")
+	}
+	offer := []byte{byte(len(compressors))}
+	for _, comp := range compressors {
+		name := comp.Name()
+		if len(name) == 0 || len(name) > 255 {
+			return nil, errors.New("socketman: invalid compressor name " + name)
+		}
+		offer = append(offer, byte(len(name)))
+		offer = append(offer, name...)
+	}
+	if _, err := rw.Write(offer); err != nil {
+		return nil, err
+	}
+	name, err := readName(rw)
+	if err != nil || name == "" {
+		return nil, err
+	}
+	for _, comp := range compressors {
+		if comp.Name() == name {
+			return comp, nil
+		}
+	}
+	return nil, errBadCompression
+}
+
+//acceptCompression reads the client's offer and answers with
+//the first of compressors it contains, if any.
+func acceptCompression(rw io.ReadWriter, compressors []Compressor) (Compressor, error) {
+	if len(compressors) == 0 {
+		return nil, nil
+	}
+	var count [1]byte
+	if _, err := io.ReadFull(rw, count[:]); err != nil {
+		return nil, err
+	}
+	offered := map[string]bool{}
+	for i := 0; i < int(count[0]); i++ {
+		name, err := readName(rw)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return nil, errBadCompression
+		}
+		offered[name] = true
+	}
+	var chosen Compressor
+	for _, comp := range compressors {
+		if offered[comp.Name()] {
+			chosen = comp
+			break
+		}
+	}
+	answer := []byte{0}
+	if chosen != nil {
+		answer = append([]byte{byte(len(chosen.Name()))}, chosen.Name()...)
+	}
+	if _, err := rw.Write(answer); err != nil {
+		return nil, err
+	}
+	return chosen, nil
+}
+
+//readName reads a length prefixed name.
+func readName(r io.Reader) (string, error) {
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", err
+	}
+	name := make([]byte, size[0])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
@@ -0,0 +1,130 @@
+package socketman_test
+
+import (
+	"crypto/tls"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/azr/socketman"
+	"github.com/azr/socketman/internal"
+)
+
+// countingCompressor counts compressed bytes it writes.
+type countingCompressor struct {
+	socketman.DeflateCompressor
+	name    string
+	written int64
+}
+
+func (c *countingCompressor) Name() string { return c.name }
+
+func (c *countingCompressor) Writer(w io.Writer) (socketman.CompressWriter, error) {
+	return c.DeflateCompressor.Writer(writerFunc(func(p []byte) (int, error) {
+		atomic.AddInt64(&c.written, int64(len(p)))
+		return w.Write(p)
+	}))
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestCompression(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressors := []socketman.Compressor{socketman.DeflateCompressor{}}
+	configs := map[string][2]socketman.Config{
+		"plain":  {{Compressors: compressors}, {Compressors: compressors}},
+		"cypher": {{Compressors: compressors, CypherPool: aespool}, {Compressors: compressors, CypherPool: aespool}},
+		"tls+cypher": {
+			{Compressors: compressors, CypherPool: aespool, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}},
+			{Compressors: compressors, CypherPool: aespool, TLSConfig: &tls.Config{InsecureSkipVerify: true}},
+		},
+	}
+	for name, conf := range configs {
+		t.Run(name, func(t *testing.T) {
+			// echoes only work if each Write is flushed.
+			testEchoServer(t, &socketman.Server{Config: conf[0]}, &socketman.Client{Config: conf[1]})
+			testEchoClient(t, &socketman.Server{Config: conf[0]}, &socketman.Client{Config: conf[1]})
+		})
+	}
+}
+
+func TestCompression_compresses(t *testing.T) {
+	comp := &countingCompressor{name: "counting"}
+	config := socketman.Config{
+		Compressors: []socketman.Compressor{comp},
+		CypherPool:  aespool,
+	}
+	data := make([]byte, 64<<10)
+	var read []byte
+	test(t, &socketman.Server{Config: config}, func(c io.ReadWriter) {
+		read, _ = io.ReadAll(io.LimitReader(c, int64(len(data))))
+	}, &socketman.Client{Config: config}, func(c io.ReadWriter) {
+		c.Write(data)
+		c.Read(make([]byte, 1)) // until the server is done
+	})
+	if len(read) != len(data) {
+		t.Fatalf("expected %d bytes, got %d", len(data), len(read))
+	}
+	if n := atomic.LoadInt64(&comp.written); n == 0 || n > 1<<10 {
+		t.Fatalf("expected zeros to compress to less than 1KB, got %d bytes", n)
+	}
+}
+
+func TestCompression_negotiation(t *testing.T) {
+	deflate := &countingCompressor{name: "deflate"}
+	other := &countingCompressor{name: "other"}
+	tests := map[string]struct {
+		server, client []socketman.Compressor
+		used           *countingCompressor
+	}{
+		"server preference": {
+			server: []socketman.Compressor{deflate, other},
+			client: []socketman.Compressor{other, deflate},
+			used:   deflate,
+		},
+		"common algorithm": {
+			server: []socketman.Compressor{deflate, other},
+			client: []socketman.Compressor{other},
+			used:   other,
+		},
+		"no common algorithm": {
+			server: []socketman.Compressor{deflate},
+			client: []socketman.Compressor{other},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			atomic.StoreInt64(&deflate.written, 0)
+			atomic.StoreInt64(&other.written, 0)
+			testEchoServer(t,
+				&socketman.Server{Config: socketman.Config{Compressors: tt.server}},
+				&socketman.Client{Config: socketman.Config{Compressors: tt.client}})
+			for _, comp := range []*countingCompressor{deflate, other} {
+				if used := atomic.LoadInt64(&comp.written) > 0; used != (comp == tt.used) {
+					t.Errorf("%s used: %v", comp.name, used)
+				}
+			}
+		})
+	}
+}
+
+func TestCompression_invalidLevel(t *testing.T) {
+	config := socketman.Config{
+		Compressors: []socketman.Compressor{socketman.DeflateCompressor{Level: 42}},
+	}
+	server := &socketman.Server{Config: config}
+	defer serve(t, server, socketman.HandlerFunc(func(io.ReadWriter) {
+		t.Error("server handler should not run")
+	}))()
+	err := (&socketman.Client{Config: config}).ConnectFunc(addr, func(io.ReadWriter) {
+		t.Error("client handler should not run")
+	})
+	if err == nil {
+		t.Fatal("an invalid level should fail the connection")
+	}
+}
@@ -9,14 +9,16 @@ import (
 //Config is not thread safe. Make sure it's configured before
 //you start your client/server to avoid races.
 //server/client will only read on values.
+//
+//I/O exceeding one of the timeouts returns a *TimeoutError.
 type Config struct {
 	// TLS config for secure Sockets
 	TLSConfig *tls.Config
 
 	CypherPool
 
-	// After a connection is opened and after each successful I/O call
-	// SetDeadline will be called upon that connection.
+	// Once a connection saw no successful I/O for IdleTimeout
+	// its deadline expires.
 	//
 	// A deadline is an absolute time after which I/O operations
 	// fail with a timeout (see type net.Error) instead of
@@ -25,4 +27,51 @@ type Config struct {
 	//
 	// A zero value means I/O operations will not time out.
 	IdleTimeout time.Duration
+
+	//ReadTimeout and WriteTimeout bound each Read and Write
+	//call of handlers, whatever other I/O happens meanwhile.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	//HandshakeTimeout bounds TLS and websocket handshakes,
+	//and dialing for a Client, proxy handshakes included.
+	HandshakeTimeout time.Duration
+
+	//MaxConnectionAge, if set, makes I/O fail once a connection
+	//lived that long, plus a random duration of up to
+	//MaxConnectionAgeJitter so connections don't all expire
+	//at once.
+	MaxConnectionAge       time.Duration
+	MaxConnectionAgeJitter time.Duration
+
+	//Compressors, if set, compress connections with the first
+	//algorithm of the server's list the client supports.
+	//It's negotiated when connecting, so both ends must set it.
+	//Data is compressed before CypherPool encrypts it, and
+	//flushed after each Write.
+	//A timed out Read breaks a compressed stream.
+	Compressors []Compressor
+
+	//Authorize, if set, is called with the identity of the peer
+	//once connected, before handlers run. The identity is nil if
+	//the peer presented no certificate, or TLS is not used.
+	//Returning an error refuses the connection.
+	//
+	//A Server's Authorize also applies to connections of
+	//VirtualHosts setting none.
+	Authorize func(id *PeerIdentity) error
+
+	//Negotiation, if set, makes ends check they agree on
+	//encryption, compression and framing when connecting.
+	Negotiation *Negotiation
+
+	//RateLimit throttles bandwidth, per connection and globally.
+	RateLimit RateLimit
+
+	//TCP tunes TCP sockets.
+	TCP TCPOptions
+
+	//WebSocket, if set, makes a server speak websocket and configures
+	//websocket connections of a client. See WebSocketConfig.
+	WebSocket *WebSocketConfig
 }
@@ -1,15 +1,20 @@
 package socketman
 
 import (
+	"crypto/tls"
 	"io"
 	"log"
+	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 //net con embeds a net.Conn
-// it allows to bump I/O deadline
-// after each successfull read/write.
+// it allows to time out idle connections:
+// reads/writes only record activity, a timer
+// checks it once per IdleTimeout.
 // in client and/or server.
 // if config containts a CypherPool
 // one reader and one writer will be
@@ -17,11 +22,29 @@ import (
 // the net.Conn. This allows encrypting
 // sent messages.
 type conn struct {
+	activity int64 // nanoseconds from start to the last I/O; first for atomic alignment
+	start    time.Time
+
 	netCon net.Conn
 	w      io.Writer
 	r      io.Reader
-	io.Closer
 	Config
+
+	closeOnce sync.Once
+	closeErr  error
+	done      chan struct{} // closed by Close
+
+	readLimit, writeLimit *RateLimiter // set by RateLimit
+	compressed            bool         // set by compress
+
+	dmu       sync.Mutex  // guards deadlines and fields below
+	idle      time.Time   // set by IdleTimeout, once idle
+	age       time.Time   // set by MaxConnectionAge
+	readOp    time.Time   // set by ReadTimeout, during a Read
+	writeOp   time.Time   // set by WriteTimeout, during a Write
+	sniff     time.Time   // set by a Router, while sniffing
+	idleTimer *time.Timer // checks activity
+	closed    bool
 }
 
 func newconn(netConn net.Conn, conf Config) *conn {
@@ -29,8 +52,11 @@ func newconn(netConn net.Conn, conf Config) *conn {
 		netCon: netConn,
 		w:      netConn,
 		r:      netConn,
-		Closer: netConn,
 		Config: conf,
+		done:   make(chan struct{}),
+
+		readLimit:  NewRateLimiter(conf.RateLimit.Read, 0),
+		writeLimit: NewRateLimiter(conf.RateLimit.Write, 0),
 	}
 	if conf.CypherPool != nil {
 		if conf.CypherPool.Reader != nil {
@@ -40,28 +66,221 @@ func newconn(netConn net.Conn, conf Config) *conn {
 			c.w = conf.CypherPool.Writer(netConn)
 		}
 	}
+
+	now := time.Now()
+	c.start = now
+	if conf.MaxConnectionAge > 0 {
+		age := conf.MaxConnectionAge
+		if conf.MaxConnectionAgeJitter > 0 {
+			age += time.Duration(rand.Int63n(int64(conf.MaxConnectionAgeJitter)))
+		}
+		c.age = now.Add(age)
+	}
+	// replaces handshake or accept deadlines, which may
+	// come from another Config, like a Server's for a VirtualHost.
+	c.setDeadlines()
+	if conf.IdleTimeout != 0 {
+		c.dmu.Lock()
+		c.idleTimer = time.AfterFunc(conf.IdleTimeout, c.checkIdle)
+		c.dmu.Unlock()
+	}
 	return c
 }
 
-func (c *conn) resetDeadline() {
-	err := c.netCon.SetDeadline(time.Now().Add(c.Config.IdleTimeout))
+//connOf returns the socketman connection behind rw,
+//as handed to a Handler.
+func connOf(rw io.ReadWriter) (*conn, bool) {
+	c, ok := rw.(*conn)
+	return c, ok
+}
+
+//rawConn returns the transport connection under c,
+//unwrapping TLS or buffering layers.
+func rawConn(c net.Conn) net.Conn {
+	for {
+		nc, ok := c.(interface {
+			NetConn() net.Conn
+		})
+		if !ok {
+			return c
+		}
+		c = nc.NetConn()
+	}
+}
+
+//tlsState returns the TLS state of c,
+//nil if it's not a TLS connection.
+func tlsState(c net.Conn) *tls.ConnectionState {
+	for {
+		if tc, ok := c.(*tls.Conn); ok {
+			state := tc.ConnectionState()
+			return &state
+		}
+		nc, ok := c.(interface {
+			NetConn() net.Conn
+		})
+		if !ok {
+			return nil
+		}
+		c = nc.NetConn()
+	}
+}
+
+//Close closes the connection once, so handlers
+//can close it before the Client or Server does.
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.dmu.Lock()
+		c.closed = true
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		c.dmu.Unlock()
+		close(c.done)
+		c.closeErr = c.netCon.Close()
+	})
+	return c.closeErr
+}
+
+//setDeadlines applies the earliest deadlines of each
+//direction; c.dmu must be held, or c not shared yet.
+func (c *conn) setDeadlines() {
+	r := earliest(c.readOp, c.idle, c.age, c.sniff)
+	w := earliest(c.writeOp, c.idle, c.age)
+	var err error
+	if r.Equal(w) {
+		err = c.netCon.SetDeadline(r)
+	} else if err = c.netCon.SetReadDeadline(r); err == nil {
+		err = c.netCon.SetWriteDeadline(w)
+	}
 	if err != nil {
 		log.Printf("socketman: SetDeadline failed: %s", err)
 	}
 }
 
+//checkIdle runs when the connection may have been idle
+//for IdleTimeout. If so it expires deadlines, failing pending
+//and future I/O, otherwise it checks again later.
+func (c *conn) checkIdle() {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	if c.closed {
+		return
+	}
+	last := c.start.Add(time.Duration(atomic.LoadInt64(&c.activity)))
+	expiry := last.Add(c.Config.IdleTimeout)
+	if d := time.Until(expiry); d > 0 {
+		c.idleTimer.Reset(d)
+		return
+	}
+	c.idle = expiry
+	c.setDeadlines()
+}
+
+//setSniffDeadline bounds reads until t; zero clears it.
+func (c *conn) setSniffDeadline(t time.Time) {
+	c.dmu.Lock()
+	c.sniff = t
+	c.setDeadlines()
+	c.dmu.Unlock()
+}
+
+//startOp sets the deadline of a Read or Write
+//bounded by timeout.
+func (c *conn) startOp(op *time.Time, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	c.dmu.Lock()
+	*op = time.Now().Add(timeout)
+	c.setDeadlines()
+	c.dmu.Unlock()
+}
+
+//endOp records activity after a Read or Write of n bytes,
+//resets deadlines, and tells which timeout fired, if any.
+func (c *conn) endOp(op *time.Time, limit string, timeout time.Duration, n int, err error) error {
+	if n > 0 && c.idleTimer != nil {
+		atomic.StoreInt64(&c.activity, int64(time.Since(c.start)))
+	}
+	if op.IsZero() && (err == nil || !isTimeout(err)) {
+		return err
+	}
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	if err != nil && isTimeout(err) {
+		err = c.timeoutError(err, *op, limit, timeout)
+	}
+	*op = time.Time{}
+	c.setDeadlines()
+	return err
+}
+
+//timeoutError returns which deadline made err;
+//c.dmu must be held.
+func (c *conn) timeoutError(err error, op time.Time, limit string, timeout time.Duration) error {
+	now := time.Now()
+	fired := &TimeoutError{Err: err}
+	var at time.Time
+	for _, d := range []struct {
+		t        time.Time
+		limit    string
+		duration time.Duration
+	}{
+		{c.age, "MaxConnectionAge", c.Config.MaxConnectionAge},
+		{op, limit, timeout},
+		{c.idle, "IdleTimeout", c.Config.IdleTimeout},
+	} {
+		if d.t.IsZero() || now.Before(d.t) {
+			continue
+		}
+		if at.IsZero() || d.t.Before(at) {
+			at = d.t
+			fired.Limit, fired.Duration = d.limit, d.duration
+		}
+	}
+	if at.IsZero() {
+		return err
+	}
+	return fired
+}
+
+//Write splits b in chunks rate limiters allow at once.
 func (c *conn) Write(b []byte) (n int, err error) {
-	n, err = c.w.Write(b)
-	if n > 0 && c.Config.IdleTimeout != 0 {
-		c.resetDeadline()
+	size := c.RateLimit.GlobalWrite.chunk(c.writeLimit.chunk(len(b)))
+	if size == len(b) {
+		return c.write(b)
+	}
+	for n < len(b) && err == nil {
+		end := n + size
+		if end > len(b) {
+			end = len(b)
+		}
+		var m int
+		m, err = c.write(b[n:end])
+		n += m
 	}
 	return n, err
 }
 
+func (c *conn) write(b []byte) (n int, err error) {
+	if err := c.throttle(len(b), c.writeLimit, c.RateLimit.GlobalWrite); err != nil {
+		return 0, err
+	}
+	c.startOp(&c.writeOp, c.Config.WriteTimeout)
+	n, err = c.w.Write(b)
+	return n, c.endOp(&c.writeOp, "WriteTimeout", c.Config.WriteTimeout, n, err)
+}
+
+//Read is throttled after reading, for the bytes read.
 func (c *conn) Read(b []byte) (n int, err error) {
+	b = b[:c.RateLimit.GlobalRead.chunk(c.readLimit.chunk(len(b)))]
+	c.startOp(&c.readOp, c.Config.ReadTimeout)
 	n, err = c.r.Read(b)
-	if n > 0 && c.Config.IdleTimeout != 0 {
-		c.resetDeadline()
+	err = c.endOp(&c.readOp, "ReadTimeout", c.Config.ReadTimeout, n, err)
+	if n > 0 {
+		// data was read, closing only cuts the wait.
+		c.throttle(n, c.readLimit, c.RateLimit.GlobalRead)
 	}
 	return n, err
 }
@@ -1,7 +1,14 @@
 package socketman_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"io"
+	"math/big"
 	"sync"
 	"testing"
 	"time"
@@ -18,16 +25,21 @@ var (
 	}
 )
 
+const addr = "127.0.0.1:1234"
+
 func test(t *testing.T, server *socketman.Server, serverHandler func(io.ReadWriter), client *socketman.Client, clientHandler func(io.ReadWriter)) {
-	addr := "127.0.0.1:1234"
+	testAt(t, addr, server, serverHandler, addr, client, clientHandler)
+}
 
+// testAt is like test but server listens on laddr and client dials daddr.
+func testAt(t *testing.T, laddr string, server *socketman.Server, serverHandler func(io.ReadWriter), daddr string, client *socketman.Client, clientHandler func(io.ReadWriter)) {
 	//start server
 	serverTasks := sync.WaitGroup{}
 	serverTasks.Add(1)
 
 	go func() {
 		defer serverTasks.Done()
-		if err := server.ListenAndServeFunc(addr, serverHandler); err != nil {
+		if err := server.ListenAndServeFunc(laddr, serverHandler); err != nil {
 			t.Logf("ListenAndServeFunc returned: %s.", err)
 		}
 	}()
@@ -36,7 +48,7 @@ func test(t *testing.T, server *socketman.Server, serverHandler func(io.ReadWrit
 
 	clientTasks := sync.WaitGroup{}
 	clientTasks.Add(1)
-	err := client.ConnectFunc(addr, func(c io.ReadWriter) {
+	err := client.ConnectFunc(daddr, func(c io.ReadWriter) {
 		defer clientTasks.Done()
 		clientHandler(c)
 	})
@@ -52,10 +64,14 @@ func test(t *testing.T, server *socketman.Server, serverHandler func(io.ReadWrit
 }
 
 func testEchoServer(t *testing.T, server *socketman.Server, client *socketman.Client) {
+	testEchoServerAt(t, addr, server, addr, client)
+}
+
+func testEchoServerAt(t *testing.T, laddr string, server *socketman.Server, daddr string, client *socketman.Client) {
 	in := "hello, world!"
 	out := make([]byte, len(in))
 
-	test(t, server, echoHandler, client, func(c io.ReadWriter) {
+	testAt(t, laddr, server, echoHandler, daddr, client, func(c io.ReadWriter) {
 		for i := 0; i < len(in); {
 			w, err := io.WriteString(c, in)
 			if err != nil {
@@ -85,10 +101,14 @@ func testEchoServer(t *testing.T, server *socketman.Server, client *socketman.Cl
 }
 
 func testEchoClient(t *testing.T, server *socketman.Server, client *socketman.Client) {
+	testEchoClientAt(t, addr, server, addr, client)
+}
+
+func testEchoClientAt(t *testing.T, laddr string, server *socketman.Server, daddr string, client *socketman.Client) {
 	in := "hello, world!"
 	out := make([]byte, len(in))
 
-	test(t, server, func(c io.ReadWriter) {
+	testAt(t, laddr, server, func(c io.ReadWriter) {
 		for i := 0; i < len(in); {
 			w, err := io.WriteString(c, in)
 			if err != nil {
@@ -105,9 +125,40 @@ func testEchoClient(t *testing.T, server *socketman.Server, client *socketman.Cl
 			i += r
 		}
 		t.Logf("got stuff: %s", out)
-	}, client, echoHandler)
+	}, daddr, client, echoHandler)
 
 	if string(out) != in {
 		t.Fatalf("failed reading with simple echo handler: expected :%s, got %s", in, out)
 	}
 }
+
+// selfSigned returns a certificate for names, valid for an hour.
+func selfSigned(t testing.TB, names ...string) tls.Certificate {
+	return signed(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	})
+}
+
+// signed returns a self signed certificate of template,
+// valid for an hour.
+func signed(t testing.TB, template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
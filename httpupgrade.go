@@ -0,0 +1,161 @@
+package socketman
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+)
+
+//UpgradeProtocol is the Upgrade header token of socketman
+//connections upgraded from HTTP.
+const UpgradeProtocol = "socketman"
+
+//UpgradeHandler is an http.Handler running Handler on connections
+//upgraded from HTTP/1.1 requests, so socketman handlers can be
+//mounted on a route of a net/http server.
+//
+//Clients connect with "http://" and "https://" urls.
+//
+//Timeouts, Compressors, Authorize and CypherPool of Config
+//apply; TLS is left to the http server, and WebSocket is
+//not supported.
+//Upgraded connections are hijacked: http.Server.Shutdown
+//does not wait for them.
+type UpgradeHandler struct {
+	Config
+
+	Handler Handler
+}
+
+//ServeHTTP upgrades the connection and runs h.Handler.
+func (h *UpgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", UpgradeProtocol) {
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", UpgradeProtocol)
+		http.Error(w, "socketman upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if err := h.Config.authorize(r.TLS); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "socketman: connection can't be hijacked", http.StatusInternalServerError)
+		return
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("socketman: hijack failed: %s", err)
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("socketman: panic serving %v: %v\n%s", r.URL, err, buf)
+			c.Close()
+		}
+	}()
+
+	// replace deadlines the http server set,
+	// until newconn sets the connection's own.
+	deadline, _ := h.Config.setupDeadline()
+	c.SetDeadline(deadline)
+	if err := writeResponse(c, http.StatusSwitchingProtocols, http.Header{
+		"Connection": {"Upgrade"},
+		"Upgrade":    {UpgradeProtocol},
+	}); err != nil {
+		c.Close()
+		return
+	}
+	if brw.Reader.Buffered() > 0 {
+		c = &bufferedConn{Conn: c, r: brw.Reader}
+	}
+	comp, err := h.Config.negotiate(c, false)
+	if err != nil {
+		c.Close()
+		return
+	}
+	conn := newconn(c, h.Config)
+	if err := conn.compress(comp); err != nil {
+		log.Printf("socketman: compression failed: %s", err)
+		conn.Close()
+		return
+	}
+	h.Handler.ServeSocket(conn)
+	if err := conn.Close(); err != nil {
+		log.Printf("socketman: connection close failed: %s", err)
+	}
+}
+
+//upgradeURL parses addr if it's an http url.
+func upgradeURL(addr string) (*url.URL, bool) {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		return nil, false
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, false
+	}
+	return u, true
+}
+
+//dialUpgrade connects to the UpgradeHandler at url u.
+func (c *Client) dialUpgrade(u *url.URL) (net.Conn, error) {
+	con, err := c.dialURL(u, u.Scheme == "https")
+	if err != nil {
+		return nil, err
+	}
+	upgraded, err := clientUpgrade(con, u)
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+	return upgraded, nil
+}
+
+//clientUpgrade sends an upgrade request for u on con.
+func clientUpgrade(con net.Conn, u *url.URL) (net.Conn, error) {
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Connection": {"Upgrade"},
+			"Upgrade":    {UpgradeProtocol},
+		},
+		Host: u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	if err := req.Write(con); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(con)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, errors.New("socketman: upgrade refused: server answered " + resp.Status)
+	}
+	if !headerContains(resp.Header, "Upgrade", UpgradeProtocol) {
+		return nil, errors.New("socketman: upgrade refused: server switched to " + resp.Header.Get("Upgrade"))
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: con, r: br}, nil
+	}
+	return con, nil
+}
@@ -0,0 +1,104 @@
+package socketman_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+)
+
+func TestUpgradeHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/socket", &socketman.UpgradeHandler{
+		Config:  socketman.Config{CypherPool: aespool, IdleTimeout: time.Second},
+		Handler: socketman.HandlerFunc(echoHandler),
+	})
+	mux.Handle("/panic", &socketman.UpgradeHandler{
+		Handler: socketman.HandlerFunc(panicHandler),
+	})
+
+	for name, srv := range map[string]*httptest.Server{
+		"http":  httptest.NewServer(mux),
+		"https": httptest.NewTLSServer(mux),
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer srv.Close()
+			client := &socketman.Client{
+				Config: socketman.Config{
+					TLSConfig:  &tls.Config{InsecureSkipVerify: true},
+					CypherPool: aespool,
+				},
+			}
+			in := "hello, world!"
+			out := make([]byte, len(in))
+			err := client.ConnectFunc(srv.URL+"/socket", func(c io.ReadWriter) {
+				if _, err := io.WriteString(c, in); err != nil {
+					t.Errorf("write failed: %s", err)
+					return
+				}
+				if _, err := io.ReadFull(c, out); err != nil {
+					t.Errorf("read failed: %s", err)
+				}
+			})
+			if err != nil {
+				t.Fatalf("connect failed: %s", err)
+			}
+			if string(out) != in {
+				t.Fatalf("expected %q echoed, got %q", in, out)
+			}
+
+			if err := client.ConnectFunc(srv.URL+"/other", echoHandler); err == nil {
+				t.Fatal("connecting to an unknown route should fail")
+			}
+
+			err = client.ConnectFunc(srv.URL+"/panic", func(c io.ReadWriter) {
+				if _, err := c.Read(make([]byte, 1)); err == nil {
+					t.Error("server should hang up after a panic")
+				}
+			})
+			if err != nil {
+				t.Fatalf("connect failed: %s", err)
+			}
+
+			// the route still serves plain requests
+			resp, err := srv.Client().Get(srv.URL + "/socket")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Upgrade") != socketman.UpgradeProtocol {
+				t.Fatalf("expected upgrade required, got %s, upgrade %q", resp.Status, resp.Header.Get("Upgrade"))
+			}
+		})
+	}
+}
+
+func TestUpgradeHandler_handshakeTimeout(t *testing.T) {
+	srv := httptest.NewServer(&socketman.UpgradeHandler{
+		Config:  socketman.Config{HandshakeTimeout: 100 * time.Millisecond, Negotiation: &socketman.Negotiation{}},
+		Handler: socketman.HandlerFunc(echoHandler),
+	})
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := "GET / HTTP/1.1\r\nHost: socketman\r\nConnection: Upgrade\r\nUpgrade: " + socketman.UpgradeProtocol + "\r\n\r\n"
+	if _, err := io.WriteString(c, req); err != nil {
+		t.Fatal(err)
+	}
+	// the preamble never comes: the server hangs up
+	// once HandshakeTimeout passed.
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("server should hang up, got %s after reading %q", err, b)
+	}
+}
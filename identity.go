@@ -0,0 +1,94 @@
+package socketman
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+//PeerIdentity is who the peer of a TLS connection is,
+//according to the certificate it presented.
+type PeerIdentity struct {
+	//Certificate is the peer's certificate.
+	Certificate *x509.Certificate
+
+	//VerifiedChains are the chains the certificate was verified
+	//with, leaf first. They are empty if it was not verified,
+	//like with tls.RequireAnyClientCert: check Verified before
+	//trusting names.
+	VerifiedChains [][]*x509.Certificate
+
+	CommonName string
+	DNSNames   []string
+	URIs       []*url.URL
+
+	//SPIFFEID is the first "spiffe" URI of URIs, if any.
+	SPIFFEID *url.URL
+}
+
+//Verified tells whether the certificate was verified.
+func (id *PeerIdentity) Verified() bool {
+	return len(id.VerifiedChains) > 0
+}
+
+var (
+	//ErrNotTLS is returned when TLS only information
+	//is asked about another kind of connection.
+	ErrNotTLS = errors.New("socketman: not a TLS connection")
+
+	//ErrNoPeerCertificate is returned when the peer
+	//of a TLS connection presented no certificate.
+	ErrNoPeerCertificate = errors.New("socketman: no peer certificate")
+)
+
+//Identity returns the identity of the peer of a connection
+//handed to a Handler. The connection must use TLS, and the peer
+//present a certificate: servers must set TLSConfig.ClientAuth.
+func Identity(rw io.ReadWriter) (*PeerIdentity, error) {
+	c, ok := connOf(rw)
+	if !ok {
+		return nil, errors.New("socketman: not a socketman connection")
+	}
+	return newPeerIdentity(tlsState(c.netCon))
+}
+
+//newPeerIdentity returns the identity of state's peer.
+func newPeerIdentity(state *tls.ConnectionState) (*PeerIdentity, error) {
+	if state == nil {
+		return nil, ErrNotTLS
+	}
+	if len(state.PeerCertificates) == 0 {
+		return nil, ErrNoPeerCertificate
+	}
+	leaf := state.PeerCertificates[0]
+	id := &PeerIdentity{
+		Certificate:    leaf,
+		VerifiedChains: state.VerifiedChains,
+		CommonName:     leaf.Subject.CommonName,
+		DNSNames:       leaf.DNSNames,
+		URIs:           leaf.URIs,
+	}
+	for _, u := range leaf.URIs {
+		if u.Scheme == "spiffe" {
+			id.SPIFFEID = u
+			break
+		}
+	}
+	return id, nil
+}
+
+//authorize runs c.Authorize with the identity of
+//the peer of state, a nil state meaning no TLS.
+func (c *Config) authorize(state *tls.ConnectionState) error {
+	if c.Authorize == nil {
+		return nil
+	}
+	id, _ := newPeerIdentity(state)
+	if err := c.Authorize(id); err != nil {
+		return fmt.Errorf("socketman: peer not authorized: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package socketman_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"net/url"
+	"testing"
+
+	"github.com/azr/socketman"
+)
+
+func spiffeCert(t *testing.T, name string) tls.Certificate {
+	id, _ := url.Parse("spiffe://example.org/ns/prod/sa/" + name)
+	return signed(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name + ".example.org"},
+		URIs:     []*url.URL{{Scheme: "https", Host: "example.org"}, id},
+	})
+}
+
+func TestIdentity(t *testing.T) {
+	alice, bob := spiffeCert(t, "alice"), spiffeCert(t, "bob")
+	cas := x509.NewCertPool()
+	cas.AddCert(alice.Leaf)
+	cas.AddCert(bob.Leaf)
+	server := &socketman.Server{Config: socketman.Config{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{selfSigned(t, "server.example.org")},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    cas,
+		},
+		Authorize: func(id *socketman.PeerIdentity) error {
+			if id == nil || !id.Verified() || id.SPIFFEID.String() != "spiffe://example.org/ns/prod/sa/alice" {
+				return errors.New("only alice")
+			}
+			return nil
+		},
+	}}
+	var id *socketman.PeerIdentity
+	defer serve(t, server, socketman.HandlerFunc(func(c io.ReadWriter) {
+		var err error
+		if id, err = socketman.Identity(c); err != nil {
+			t.Errorf("identity: %s", err)
+		}
+		io.WriteString(c, "ok:")
+	}))()
+
+	client := func(cert tls.Certificate) *socketman.Client {
+		c := vhostClient("server.example.org", nil)
+		c.Config.TLSConfig.Certificates = []tls.Certificate{cert}
+		return c
+	}
+	if !connects(client(alice)) {
+		t.Fatal("alice should be authorized")
+	}
+	if id.CommonName != "alice" || len(id.DNSNames) != 1 || id.DNSNames[0] != "alice.example.org" ||
+		len(id.URIs) != 2 || len(id.VerifiedChains) != 1 || !id.Certificate.Equal(alice.Leaf) {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+	if connects(client(bob)) {
+		t.Fatal("bob should be refused before the handler runs")
+	}
+}
+
+func TestIdentity_errors(t *testing.T) {
+	tests := map[string]struct {
+		server *socketman.Server
+		client *socketman.Client
+		err    error
+	}{
+		"plain": {&socketman.Server{}, &socketman.Client{}, socketman.ErrNotTLS},
+		"no client certificate": {
+			&socketman.Server{Config: socketman.Config{TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{selfSigned(t, "server.example.org")},
+			}}},
+			vhostClient("server.example.org", nil),
+			socketman.ErrNoPeerCertificate,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var err error
+			test(t, tt.server, func(c io.ReadWriter) {
+				_, err = socketman.Identity(c)
+			}, tt.client, func(c io.ReadWriter) {
+				c.Read(make([]byte, 1)) // until the server is done
+			})
+			if err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+	if _, err := socketman.Identity(struct{ io.ReadWriter }{}); err == nil {
+		t.Fatal("expected an error for other connections")
+	}
+}
+
+func TestIdentity_clientAuthorize(t *testing.T) {
+	server := &socketman.Server{Config: socketman.Config{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{selfSigned(t, "server.example.org")},
+	}}}
+	defer serve(t, server, named("ok", 0))()
+
+	refused := errors.New("unexpected server")
+	client := vhostClient("server.example.org", nil)
+	client.Config.Authorize = func(id *socketman.PeerIdentity) error {
+		if id.CommonName != "other.example.org" {
+			return refused
+		}
+		return nil
+	}
+	err := client.ConnectFunc(addr, func(c io.ReadWriter) {
+		t.Error("handler should not run")
+	})
+	if !errors.Is(err, refused) {
+		t.Fatalf("expected the Authorize error, got %v", err)
+	}
+}
+
+func TestIdentity_virtualHosts(t *testing.T) {
+	alice, bob := spiffeCert(t, "alice"), spiffeCert(t, "bob")
+	cas := x509.NewCertPool()
+	cas.AddCert(alice.Leaf)
+	cas.AddCert(bob.Leaf)
+	server := &socketman.Server{
+		Config: socketman.Config{
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{selfSigned(t, "a.example.org", "b.example.org")},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    cas,
+			},
+			Authorize: func(id *socketman.PeerIdentity) error {
+				if id.CommonName != "alice" {
+					return errors.New("only alice")
+				}
+				return nil
+			},
+		},
+		VirtualHosts: map[string]*socketman.VirtualHost{
+			// without Authorize, the server's applies.
+			"a.example.org": {Handler: named("ok", 0)},
+			"b.example.org": {Config: socketman.Config{
+				Authorize: func(*socketman.PeerIdentity) error { return nil },
+			}},
+		},
+	}
+	defer serve(t, server, named("ok", 0))()
+
+	client := func(name string, cert tls.Certificate) *socketman.Client {
+		c := vhostClient(name, nil)
+		c.Config.TLSConfig.Certificates = []tls.Certificate{cert}
+		return c
+	}
+	if !connects(client("a.example.org", alice)) {
+		t.Fatal("alice should be authorized")
+	}
+	if connects(client("a.example.org", bob)) {
+		t.Fatal("bob should be refused by the server's Authorize")
+	}
+	if !connects(client("b.example.org", bob)) {
+		t.Fatal("bob should be authorized by the virtual host's Authorize")
+	}
+}
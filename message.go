@@ -0,0 +1,366 @@
+package socketman
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//DefaultMaxMessageSize is the maximum message size
+//of a MessageConn when Framing.MaxMessageSize is zero.
+const DefaultMaxMessageSize = 4 << 20
+
+//maxRetainedBuffer is the largest write buffer
+//a MessageConn keeps between messages.
+const maxRetainedBuffer = 64 << 10
+
+//ErrMessageTooLarge is returned when a message
+//exceeds Framing.MaxMessageSize.
+var ErrMessageTooLarge = errors.New("socketman: message too large")
+
+//ErrHeartbeatTimeout is returned by a MessageConn
+//whose peer missed too many heartbeats.
+var ErrHeartbeatTimeout = errors.New("socketman: heartbeat timeout")
+
+//ErrMessageConnClosed is returned reading
+//a MessageConn after Close.
+var ErrMessageConnClosed = errors.New("socketman: message conn closed")
+
+//DefaultHeartbeatInterval is the Interval of
+//a Heartbeat when zero.
+const DefaultHeartbeatInterval = 30 * time.Second
+
+//Message kinds, when heartbeats are enabled.
+const (
+	messageData = 0
+	messagePing = 1
+	messagePong = 2
+)
+
+//Framing configures how a MessageConn delimits messages.
+//Both ends of a connection must use the same Framing.
+type Framing struct {
+	//FixedLength prefixes messages with their length as a big
+	//endian uint32 instead of a uvarint.
+	FixedLength bool
+
+	//MaxMessageSize is the maximum size of a message payload.
+	//Zero means DefaultMaxMessageSize.
+	MaxMessageSize int
+
+	//ReuseBuffer makes ReadMessage return a slice of an internal
+	//buffer instead of a fresh copy; it's only valid until the
+	//next call to ReadMessage.
+	//It has no effect with a Heartbeat.
+	ReuseBuffer bool
+
+	//Heartbeat, if set, enables heartbeats.
+	Heartbeat *Heartbeat
+}
+
+//Heartbeat configures heartbeats of a MessageConn.
+//
+//Pings are sent every Interval and answered by the peer's
+//MessageConn, telling it's alive and measuring round trip times.
+//A peer missing MaxMissed pings in a row is considered dead and the
+//connection is closed.
+//Heartbeats are I/O: an Interval below IdleTimeout keeps
+//idle but healthy connections alive.
+type Heartbeat struct {
+	//Interval defaults to DefaultHeartbeatInterval;
+	//negative values too.
+	Interval time.Duration
+
+	//MaxMissed defaults to 3.
+	MaxMissed int
+}
+
+func (h *Heartbeat) interval() time.Duration {
+	if h.Interval > 0 {
+		return h.Interval
+	}
+	return DefaultHeartbeatInterval
+}
+
+func (h *Heartbeat) maxMissed() int32 {
+	if h.MaxMissed > 0 {
+		return int32(h.MaxMissed)
+	}
+	return 3
+}
+
+func (f Framing) maxMessageSize() int {
+	if f.MaxMessageSize > 0 {
+		return f.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+//MessageConn reads and writes length prefixed messages
+//on a stream, like the one handed to a Handler.
+//
+//It works the same on top of plain, TLS or CypherPool encrypted
+//connections. ReadMessage and WriteMessage can be called
+//concurrently with each other; WriteMessage is safe for
+//concurrent use.
+//
+//With a Heartbeat, messages are read by a background goroutine
+//answering pings; it waits for ReadMessage calls to hand
+//messages over.
+type MessageConn struct {
+	framing Framing
+	rw      io.ReadWriter
+	r       *bufio.Reader
+	w       io.Writer
+	rbuf    []byte
+
+	wmu  sync.Mutex // guards wbuf and writes
+	wbuf []byte
+
+	closing   chan struct{} // closed by Close
+	closeOnce sync.Once
+	closeErr  error
+
+	// heartbeat
+	in         chan []byte   // messages read by readLoop
+	done       chan struct{} // closed when readLoop returns
+	readErr    error         // set before done is closed
+	stop       chan struct{} // closed once the peer is dead
+	pingErr    atomic.Value  // error of a failed ping, set before closing rw
+	missed     int32         // pings sent since the last received frame
+	delivering int32         // 1 while readLoop waits for ReadMessage
+	dead       int32         // 1 once the peer missed too many pings
+	rtt        int64         // last round trip time
+}
+
+//NewMessageConn returns a MessageConn sending messages on rw.
+//
+//MessageConn buffers reads, so rw should not be read
+//directly afterwards.
+func NewMessageConn(rw io.ReadWriter, f Framing) *MessageConn {
+	m := &MessageConn{
+		framing: f,
+		rw:      rw,
+		r:       bufio.NewReader(rw),
+		w:       rw,
+		closing: make(chan struct{}),
+	}
+	if f.Heartbeat != nil {
+		m.framing.ReuseBuffer = false
+		m.in = make(chan []byte)
+		m.done = make(chan struct{})
+		m.stop = make(chan struct{})
+		go m.readLoop()
+		go m.heartbeat()
+	}
+	return m
+}
+
+//ReadMessage reads the next message.
+func (m *MessageConn) ReadMessage() ([]byte, error) {
+	select {
+	case <-m.closing:
+		return nil, ErrMessageConnClosed
+	default:
+	}
+	if m.framing.Heartbeat == nil {
+		_, p, err := m.readFrame()
+		return p, err
+	}
+	select {
+	case p := <-m.in:
+		return p, nil
+	case <-m.done:
+		return nil, m.readErr
+	case <-m.stop:
+		return nil, ErrHeartbeatTimeout
+	case <-m.closing:
+		return nil, ErrMessageConnClosed
+	}
+}
+
+//Close stops heartbeats and closes the
+//underlying stream, if it's an io.Closer.
+func (m *MessageConn) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closing)
+		m.closeErr = m.close()
+	})
+	return m.closeErr
+}
+
+//RTT returns the last round trip time measured by
+//heartbeats, zero if none yet.
+func (m *MessageConn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.rtt))
+}
+
+//readFrame reads a message and its kind.
+func (m *MessageConn) readFrame() (byte, []byte, error) {
+	max := m.framing.maxMessageSize()
+	if m.framing.Heartbeat != nil {
+		max++ // kind byte
+	}
+	var size uint64
+	if m.framing.FixedLength {
+		var hdr [4]byte
+		if _, err := io.ReadFull(m.r, hdr[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint32(hdr[:]))
+	} else {
+		var err error
+		size, err = binary.ReadUvarint(m.r)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if size > uint64(max) {
+		return 0, nil, fmt.Errorf("%w: %d bytes announced", ErrMessageTooLarge, size)
+	}
+
+	var b []byte
+	if m.framing.ReuseBuffer {
+		if cap(m.rbuf) < int(size) {
+			m.rbuf = make([]byte, size)
+		}
+		b = m.rbuf[:size]
+	} else {
+		b = make([]byte, size)
+	}
+	if _, err := io.ReadFull(m.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	if m.framing.Heartbeat == nil {
+		return messageData, b, nil
+	}
+	if len(b) == 0 {
+		return 0, nil, errors.New("socketman: message without kind")
+	}
+	return b[0], b[1:], nil
+}
+
+//readLoop reads messages when heartbeats are enabled.
+func (m *MessageConn) readLoop() {
+	defer close(m.done)
+	for {
+		kind, p, err := m.readFrame()
+		if err != nil {
+			if atomic.LoadInt32(&m.dead) == 1 {
+				err = ErrHeartbeatTimeout
+			} else if pingErr, ok := m.pingErr.Load().(error); ok {
+				err = pingErr
+			}
+			m.readErr = err
+			return
+		}
+		atomic.StoreInt32(&m.missed, 0)
+		switch kind {
+		case messageData:
+			atomic.StoreInt32(&m.delivering, 1)
+			select {
+			case m.in <- p:
+			case <-m.stop:
+			case <-m.closing:
+			}
+			atomic.StoreInt32(&m.delivering, 0)
+		case messagePing:
+			m.writeFrame(messagePong, p)
+		case messagePong:
+			if len(p) == 8 {
+				sent := int64(binary.BigEndian.Uint64(p))
+				atomic.StoreInt64(&m.rtt, time.Now().UnixNano()-sent)
+			}
+		default:
+			m.readErr = fmt.Errorf("socketman: unknown message kind %d", kind)
+			return
+		}
+	}
+}
+
+//heartbeat sends pings and closes the connection
+//if the peer stops answering, or a ping can't be sent.
+func (m *MessageConn) heartbeat() {
+	t := time.NewTicker(m.framing.Heartbeat.interval())
+	defer t.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-m.closing:
+			return
+		case <-t.C:
+		}
+		// a peer is not missing beats while we don't read its messages.
+		if atomic.LoadInt32(&m.delivering) == 0 &&
+			atomic.AddInt32(&m.missed, 1) > m.framing.Heartbeat.maxMissed() {
+			atomic.StoreInt32(&m.dead, 1)
+			close(m.stop)
+			m.close()
+			return
+		}
+		var ts [8]byte
+		binary.BigEndian.PutUint64(ts[:], uint64(time.Now().UnixNano()))
+		if err := m.writeFrame(messagePing, ts[:]); err != nil {
+			// readLoop returns err once rw is closed.
+			m.pingErr.Store(err)
+			m.close()
+			return
+		}
+	}
+}
+
+//close closes rw, if it can be.
+func (m *MessageConn) close() error {
+	if c, ok := m.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+//WriteMessage writes p as one message.
+func (m *MessageConn) WriteMessage(p []byte) error {
+	if len(p) > m.framing.maxMessageSize() {
+		return ErrMessageTooLarge
+	}
+	return m.writeFrame(messageData, p)
+}
+
+func (m *MessageConn) writeFrame(kind byte, p []byte) error {
+	size := len(p)
+	if m.framing.Heartbeat != nil {
+		size++
+	}
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+
+	// one write per message: avoids small packets
+	b := m.wbuf[:0]
+	if m.framing.FixedLength {
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(size))
+		b = append(b, hdr[:]...)
+	} else {
+		var hdr [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(hdr[:], uint64(size))
+		b = append(b, hdr[:n]...)
+	}
+	if m.framing.Heartbeat != nil {
+		b = append(b, kind)
+	}
+	b = append(b, p...)
+	if cap(b) <= maxRetainedBuffer {
+		m.wbuf = b
+	}
+
+	_, err := m.w.Write(b)
+	return err
+}
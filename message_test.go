@@ -0,0 +1,206 @@
+package socketman_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+	"github.com/azr/socketman/internal"
+)
+
+// messageEchoHandler echoes messages until an error occurs.
+func messageEchoHandler(f socketman.Framing) func(io.ReadWriter) {
+	return func(c io.ReadWriter) {
+		m := socketman.NewMessageConn(c, f)
+		for {
+			msg, err := m.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := m.WriteMessage(msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestMessageConn(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientTLS := &tls.Config{InsecureSkipVerify: true}
+
+	configs := map[string][2]socketman.Config{
+		"plain":      {},
+		"tls":        {{TLSConfig: serverTLS}, {TLSConfig: clientTLS}},
+		"cypher":     {{CypherPool: aespool}, {CypherPool: aespool}},
+		"tls+cypher": {{TLSConfig: serverTLS, CypherPool: aespool}, {TLSConfig: clientTLS, CypherPool: aespool}},
+	}
+	framings := map[string]socketman.Framing{
+		"varint":       {},
+		"fixed":        {FixedLength: true},
+		"reuse buffer": {ReuseBuffer: true},
+		"heartbeat":    {Heartbeat: &socketman.Heartbeat{Interval: time.Millisecond, MaxMissed: 1000}},
+	}
+	messages := [][]byte{
+		[]byte("hello, world!"),
+		{},
+		bytes.Repeat([]byte("a"), 300),   // two bytes varint
+		bytes.Repeat([]byte("b"), 70000), // three bytes varint, more than a TLS record
+		[]byte("bye"),
+	}
+
+	for cname, conf := range configs {
+		for fname, framing := range framings {
+			t.Run(cname+"/"+fname, func(t *testing.T) {
+				server := &socketman.Server{Config: conf[0]}
+				client := &socketman.Client{Config: conf[1]}
+				test(t, server, messageEchoHandler(framing), client, func(c io.ReadWriter) {
+					m := socketman.NewMessageConn(c, framing)
+					for _, msg := range messages {
+						if err := m.WriteMessage(msg); err != nil {
+							t.Errorf("write failed: %s", err)
+							return
+						}
+						echo, err := m.ReadMessage()
+						if err != nil {
+							t.Errorf("read failed: %s", err)
+							return
+						}
+						if !bytes.Equal(msg, echo) {
+							t.Errorf("expected %d bytes echoed, got %d bytes", len(msg), len(echo))
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+func TestMessageConn_maxMessageSize(t *testing.T) {
+	small := socketman.Framing{MaxMessageSize: 10}
+
+	var rerr error
+	test(t, &socketman.Server{}, func(c io.ReadWriter) {
+		_, rerr = socketman.NewMessageConn(c, small).ReadMessage()
+	}, &socketman.Client{}, func(c io.ReadWriter) {
+		m := socketman.NewMessageConn(c, small)
+		if err := m.WriteMessage(make([]byte, 11)); !errors.Is(err, socketman.ErrMessageTooLarge) {
+			t.Errorf("expected ErrMessageTooLarge on write, got %v", err)
+		}
+		// a peer with a bigger limit
+		socketman.NewMessageConn(c, socketman.Framing{}).WriteMessage(make([]byte, 11))
+		c.Read(make([]byte, 1))
+	})
+	if !errors.Is(rerr, socketman.ErrMessageTooLarge) {
+		t.Fatalf("expected ErrMessageTooLarge on read, got %v", rerr)
+	}
+}
+
+func TestMessageConn_heartbeat(t *testing.T) {
+	f := socketman.Framing{Heartbeat: &socketman.Heartbeat{Interval: 10 * time.Millisecond}}
+	server := &socketman.Server{Config: socketman.Config{IdleTimeout: 50 * time.Millisecond}}
+	client := &socketman.Client{Config: socketman.Config{IdleTimeout: 50 * time.Millisecond}}
+	test(t, server, messageEchoHandler(f), client, func(c io.ReadWriter) {
+		m := socketman.NewMessageConn(c, f)
+		// quiet for longer than IdleTimeout: heartbeats keep the connection alive.
+		time.Sleep(150 * time.Millisecond)
+		if err := m.WriteMessage([]byte("still there?")); err != nil {
+			t.Errorf("write failed: %s", err)
+			return
+		}
+		msg, err := m.ReadMessage()
+		if err != nil || string(msg) != "still there?" {
+			t.Errorf("expected echo, got %q %v", msg, err)
+		}
+		if m.RTT() <= 0 {
+			t.Errorf("expected a round trip time, got %s", m.RTT())
+		}
+	})
+}
+
+func TestMessageConn_deadPeer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2) // reads but never answers
+
+	m := socketman.NewMessageConn(c1, socketman.Framing{
+		Heartbeat: &socketman.Heartbeat{Interval: 10 * time.Millisecond, MaxMissed: 2},
+	})
+	start := time.Now()
+	if _, err := m.ReadMessage(); !errors.Is(err, socketman.ErrHeartbeatTimeout) {
+		t.Fatalf("expected ErrHeartbeatTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("dead peer took %s to detect", d)
+	}
+	if err := m.WriteMessage([]byte("x")); err == nil {
+		t.Fatal("connection to a dead peer should be closed")
+	}
+}
+
+// failingWriter is a connection whose writes fail.
+type failingWriter struct{ net.Conn }
+
+var errWriteFailed = errors.New("write failed")
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errWriteFailed }
+
+func TestMessageConn_pingFailure(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	m := socketman.NewMessageConn(failingWriter{c1}, socketman.Framing{
+		Heartbeat: &socketman.Heartbeat{Interval: 10 * time.Millisecond},
+	})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := m.ReadMessage()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, errWriteFailed) {
+			t.Fatalf("expected the ping write error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadMessage should return once a ping can't be sent")
+	}
+}
+
+func TestMessageConn_close(t *testing.T) {
+	for _, hb := range []*socketman.Heartbeat{nil, {}, {Interval: -time.Second}, {Interval: time.Millisecond}} {
+		c1, c2 := net.Pipe()
+		m := socketman.NewMessageConn(c1, socketman.Framing{Heartbeat: hb})
+		go io.Copy(io.Discard, c2)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := m.ReadMessage()
+			errc <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if err := m.Close(); err != nil {
+			t.Fatalf("close failed: %s", err)
+		}
+		select {
+		case err := <-errc:
+			if err == nil {
+				t.Fatal("ReadMessage should fail after Close")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("ReadMessage should return after Close")
+		}
+		if _, err := m.ReadMessage(); err != socketman.ErrMessageConnClosed {
+			t.Fatalf("expected ErrMessageConnClosed, got %v", err)
+		}
+		c2.Close()
+	}
+}
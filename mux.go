@@ -0,0 +1,730 @@
+package socketman
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+//Frame types and flags of the mux protocol.
+//
+//Every frame starts with a 12 bytes header: version, type,
+//flags (2 bytes), stream id (4 bytes) and length (4 bytes).
+//Length is the payload size of data frames, the window increment
+//of window update frames, an opaque value for pings and an error
+//code for go away frames.
+const (
+	muxVersion = 0
+
+	muxData         = 0
+	muxWindowUpdate = 1
+	muxPing         = 2
+	muxGoAway       = 3
+
+	muxFlagSYN = 1 // opens a stream, or is a ping request
+	muxFlagACK = 2 // accepts a stream, or is a ping answer
+	muxFlagFIN = 4 // half closes a stream
+	muxFlagRST = 8 // resets a stream
+
+	muxHeaderSize = 12
+
+	//muxInitialWindow is the window of a stream before
+	//any window update.
+	muxInitialWindow = 256 << 10
+
+	//muxMaxFrame is the maximum payload of sent data frames.
+	muxMaxFrame = 32 << 10
+)
+
+var (
+	//ErrSessionShutdown is returned using a closed mux session.
+	ErrSessionShutdown = errors.New("socketman: mux session shut down")
+
+	//ErrStreamReset is returned using a reset mux stream.
+	ErrStreamReset = errors.New("socketman: mux stream reset")
+
+	//ErrStreamClosed is returned writing to a closed mux stream.
+	ErrStreamClosed = errors.New("socketman: mux stream closed")
+
+	//ErrKeepAliveTimeout is returned when the peer of a mux
+	//session did not answer a ping in time.
+	ErrKeepAliveTimeout = errors.New("socketman: mux keepalive timeout")
+)
+
+//MuxConfig configures mux sessions.
+type MuxConfig struct {
+	//AcceptBacklog is the number of streams opened by the peer
+	//waiting to be accepted; more are reset.
+	//Zero means 256.
+	AcceptBacklog int
+
+	//StreamWindow is the receive window of streams: how many
+	//bytes a peer can send on a stream before they are read.
+	//Values below 256KB are ignored.
+	StreamWindow uint32
+
+	//KeepAliveInterval, if set, pings the peer at this interval.
+	//The session is closed if no answer comes within
+	//KeepAliveTimeout, KeepAliveInterval if zero.
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+}
+
+func (c *MuxConfig) acceptBacklog() int {
+	if c.AcceptBacklog > 0 {
+		return c.AcceptBacklog
+	}
+	return 256
+}
+
+func (c *MuxConfig) streamWindow() uint32 {
+	if c.StreamWindow > muxInitialWindow {
+		return c.StreamWindow
+	}
+	return muxInitialWindow
+}
+
+func (c *MuxConfig) keepAliveTimeout() time.Duration {
+	if c.KeepAliveTimeout > 0 {
+		return c.KeepAliveTimeout
+	}
+	return c.KeepAliveInterval
+}
+
+//MuxSession multiplexes streams over a connection.
+//
+//Both ends can open streams. Each stream has its own
+//flow control window, so a slow stream does not block others.
+type MuxSession struct {
+	rw     io.ReadWriter
+	br     *bufio.Reader
+	client bool
+	config MuxConfig
+
+	wmu sync.Mutex // serializes frames
+
+	mu      sync.Mutex // guards fields below
+	streams map[uint32]*MuxStream
+	nextID  uint32
+	goAway  bool // peer won't accept streams anymore
+	pings   map[uint32]chan struct{}
+	pingID  uint32
+	err     error
+
+	accept chan *MuxStream
+
+	// control frames sent by ctrlLoop, so
+	// the receiving loop never blocks writing.
+	ctrlMu    sync.Mutex
+	ctrl      [][]byte
+	ctrlReady chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+//NewMuxSession starts a mux session on rw, typically the connection
+//handed to a Handler. One end must be the client, the other
+//the server. A nil config uses defaults.
+//
+//rw is closed with the session, if it is an io.Closer.
+func NewMuxSession(rw io.ReadWriter, client bool, config *MuxConfig) *MuxSession {
+	if config == nil {
+		config = &MuxConfig{}
+	}
+	s := &MuxSession{
+		rw:        rw,
+		br:        bufio.NewReader(rw),
+		client:    client,
+		config:    *config,
+		streams:   map[uint32]*MuxStream{},
+		nextID:    2,
+		pings:     map[uint32]chan struct{}{},
+		accept:    make(chan *MuxStream, config.acceptBacklog()),
+		ctrlReady: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	go s.recvLoop()
+	go s.ctrlLoop()
+	if s.config.KeepAliveInterval > 0 {
+		go s.keepalive()
+	}
+	return s
+}
+
+//MuxHandler returns a Handler running a server mux session on
+//connections, and handler on each stream the client opens.
+func MuxHandler(config *MuxConfig, handler Handler) Handler {
+	return HandlerFunc(func(rw io.ReadWriter) {
+		s := NewMuxSession(rw, false, config)
+		if err := s.Serve(handler); err != nil {
+			log.Printf("socketman: mux session failed: %s", err)
+		}
+		s.Close()
+	})
+}
+
+//OpenStream opens a new stream.
+func (s *MuxSession) OpenStream() (*MuxStream, error) {
+	s.mu.Lock()
+	if s.isClosed() || s.goAway {
+		s.mu.Unlock()
+		return nil, ErrSessionShutdown
+	}
+	id := s.nextID
+	if id+2 < id {
+		s.mu.Unlock()
+		return nil, errors.New("socketman: mux stream ids exhausted")
+	}
+	s.nextID += 2
+	st := newMuxStream(id, s)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	delta := s.config.streamWindow() - muxInitialWindow
+	if err := s.write(muxFrame(muxWindowUpdate, muxFlagSYN, id, delta, nil)); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+//AcceptStream waits for a stream opened by the peer.
+func (s *MuxSession) AcceptStream() (*MuxStream, error) {
+	select {
+	case st := <-s.accept:
+		delta := s.config.streamWindow() - muxInitialWindow
+		if err := s.write(muxFrame(muxWindowUpdate, muxFlagACK, st.id, delta, nil)); err != nil {
+			return nil, err
+		}
+		return st, nil
+	case <-s.done:
+		return nil, s.closeErr()
+	}
+}
+
+//Serve accepts streams and calls handler on each of them in
+//a new goroutine. Streams are closed after handler returns.
+//
+//Serve returns when the session is closed; the error is nil
+//if it was closed normally.
+func (s *MuxSession) Serve(handler Handler) error {
+	for {
+		st, err := s.AcceptStream()
+		if err == ErrSessionShutdown {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go s.serveStream(st, handler)
+	}
+}
+
+func (s *MuxSession) serveStream(st *MuxStream, handler Handler) {
+	defer func() {
+		if err := recover(); err != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("socketman: panic serving mux stream %d: %v\n%s", st.id, err, buf)
+			st.Reset()
+		}
+	}()
+	handler.ServeSocket(st)
+	st.Close()
+}
+
+//Ping sends a ping and returns the round trip time.
+//It times out after KeepAliveTimeout, or 30 seconds.
+func (s *MuxSession) Ping() (time.Duration, error) {
+	ch := make(chan struct{})
+	s.mu.Lock()
+	id := s.pingID
+	s.pingID++
+	s.pings[id] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	s.sendControl(muxFrame(muxPing, muxFlagSYN, 0, id, nil))
+	timeout := s.config.keepAliveTimeout()
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-timer.C:
+		return 0, ErrKeepAliveTimeout
+	case <-s.done:
+		return 0, s.closeErr()
+	}
+}
+
+//NumStreams returns the number of open streams.
+func (s *MuxSession) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+//Done is closed when the session is closed.
+func (s *MuxSession) Done() <-chan struct{} {
+	return s.done
+}
+
+//Close tells the peer the session is going away,
+//and closes it with its streams.
+func (s *MuxSession) Close() error {
+	s.write(muxFrame(muxGoAway, 0, 0, 0, nil))
+	s.shutdown(nil)
+	return nil
+}
+
+//shutdown closes the session because of err, nil meaning
+//a normal closure.
+func (s *MuxSession) shutdown(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.done)
+		if c, ok := s.rw.(io.Closer); ok {
+			c.Close()
+		}
+	})
+}
+
+func (s *MuxSession) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *MuxSession) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return ErrSessionShutdown
+}
+
+func muxFrame(typ byte, flags uint16, id, length uint32, payload []byte) []byte {
+	frame := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	frame[0] = muxVersion
+	frame[1] = typ
+	binary.BigEndian.PutUint16(frame[2:], flags)
+	binary.BigEndian.PutUint32(frame[4:], id)
+	binary.BigEndian.PutUint32(frame[8:], length)
+	return append(frame, payload...)
+}
+
+//write sends a frame, shutting the session down on failure.
+func (s *MuxSession) write(frame []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return s.closeErr()
+	}
+	if _, err := s.rw.Write(frame); err != nil {
+		s.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+//sendControl queues a frame for ctrlLoop.
+func (s *MuxSession) sendControl(frame []byte) {
+	s.ctrlMu.Lock()
+	s.ctrl = append(s.ctrl, frame)
+	s.ctrlMu.Unlock()
+	select {
+	case s.ctrlReady <- struct{}{}:
+	default:
+	}
+}
+
+func (s *MuxSession) ctrlLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.ctrlReady:
+		}
+		s.ctrlMu.Lock()
+		frames := s.ctrl
+		s.ctrl = nil
+		s.ctrlMu.Unlock()
+		for _, frame := range frames {
+			if err := s.write(frame); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *MuxSession) keepalive() {
+	t := time.NewTicker(s.config.KeepAliveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if _, err := s.Ping(); err != nil {
+				s.shutdown(err)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *MuxSession) recvLoop() {
+	var hdr [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.br, hdr[:]); err != nil {
+			if err == io.EOF {
+				err = nil // peer hung up
+			}
+			s.shutdown(err)
+			return
+		}
+		if hdr[0] != muxVersion {
+			s.shutdown(errors.New("socketman: mux: unsupported version"))
+			return
+		}
+		typ := hdr[1]
+		flags := binary.BigEndian.Uint16(hdr[2:])
+		id := binary.BigEndian.Uint32(hdr[4:])
+		length := binary.BigEndian.Uint32(hdr[8:])
+
+		var err error
+		switch typ {
+		case muxData, muxWindowUpdate:
+			err = s.handleStreamFrame(typ, flags, id, length)
+		case muxPing:
+			s.handlePing(flags, length)
+		case muxGoAway:
+			s.mu.Lock()
+			s.goAway = true
+			s.mu.Unlock()
+		default:
+			err = errors.New("socketman: mux: unknown frame type")
+		}
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+	}
+}
+
+func (s *MuxSession) handleStreamFrame(typ byte, flags uint16, id, length uint32) error {
+	if flags&muxFlagSYN != 0 {
+		if err := s.incomingStream(id); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+
+	if typ == muxData {
+		if st == nil {
+			// stream is gone, drop data.
+			_, err := io.CopyN(io.Discard, s.br, int64(length))
+			return err
+		}
+		if err := st.receive(s.br, length); err != nil {
+			return err
+		}
+	} else if st != nil && length > 0 {
+		st.grow(length)
+	}
+	if st != nil {
+		st.handleFlags(flags)
+	}
+	return nil
+}
+
+//incomingStream registers a stream opened by the peer.
+func (s *MuxSession) incomingStream(id uint32) error {
+	if (id%2 == 1) == s.client {
+		return errors.New("socketman: mux: invalid stream id")
+	}
+	s.mu.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.mu.Unlock()
+		return errors.New("socketman: mux: duplicate stream id")
+	}
+	st := newMuxStream(id, s)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- st:
+	default:
+		// backlog is full
+		s.removeStream(id)
+		s.sendControl(muxFrame(muxWindowUpdate, muxFlagRST, id, 0, nil))
+	}
+	return nil
+}
+
+func (s *MuxSession) handlePing(flags uint16, opaque uint32) {
+	if flags&muxFlagSYN != 0 {
+		s.sendControl(muxFrame(muxPing, muxFlagACK, 0, opaque, nil))
+		return
+	}
+	s.mu.Lock()
+	if ch, ok := s.pings[opaque]; ok {
+		close(ch)
+		delete(s.pings, opaque)
+	}
+	s.mu.Unlock()
+}
+
+func (s *MuxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+//MuxStream is a stream of a mux session.
+//
+//Close half closes a stream: the peer reads io.EOF but
+//can still send data. Reset aborts it in both directions.
+type MuxStream struct {
+	id      uint32
+	session *MuxSession
+
+	mu          sync.Mutex // guards fields below
+	buf         bytes.Buffer
+	recvWindow  uint32 // bytes the peer can send
+	sendWindow  uint32 // bytes we can send
+	readClosed  bool
+	writeClosed bool
+	reset       bool
+
+	readReady  chan struct{}
+	writeReady chan struct{}
+}
+
+func newMuxStream(id uint32, s *MuxSession) *MuxStream {
+	return &MuxStream{
+		id:         id,
+		session:    s,
+		recvWindow: s.config.streamWindow(),
+		sendWindow: muxInitialWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+//ID returns the stream id: odd for streams opened
+//by the client, even for the server.
+func (st *MuxStream) ID() uint32 {
+	return st.id
+}
+
+//Session returns the session of the stream.
+func (st *MuxStream) Session() *MuxSession {
+	return st.session
+}
+
+//Read reads data sent by the peer.
+//It returns io.EOF once the peer closed the stream.
+func (st *MuxStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			delta := st.windowDelta()
+			st.mu.Unlock()
+			if delta > 0 {
+				st.session.sendControl(muxFrame(muxWindowUpdate, 0, st.id, delta, nil))
+			}
+			return n, nil
+		}
+		reset, readClosed := st.reset, st.readClosed
+		st.mu.Unlock()
+		switch {
+		case reset:
+			return 0, ErrStreamReset
+		case readClosed:
+			return 0, io.EOF
+		case st.session.isClosed():
+			return 0, ErrSessionShutdown
+		}
+		select {
+		case <-st.readReady:
+		case <-st.session.done:
+		}
+	}
+}
+
+//windowDelta grows the receive window once half
+//of it was read, st.mu must be held.
+func (st *MuxStream) windowDelta() uint32 {
+	max := st.session.config.streamWindow()
+	delta := max - uint32(st.buf.Len()) - st.recvWindow
+	if delta < max/2 {
+		return 0
+	}
+	st.recvWindow += delta
+	return delta
+}
+
+//Write sends p, waiting for the peer to read when
+//the send window is exhausted.
+func (st *MuxStream) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return n, ErrStreamReset
+		case st.writeClosed:
+			st.mu.Unlock()
+			return n, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			st.mu.Unlock()
+			select {
+			case <-st.writeReady:
+			case <-st.session.done:
+				return n, st.session.closeErr()
+			}
+			continue
+		}
+		chunk := uint32(len(p))
+		if chunk > st.sendWindow {
+			chunk = st.sendWindow
+		}
+		if chunk > muxMaxFrame {
+			chunk = muxMaxFrame
+		}
+		st.sendWindow -= chunk
+		st.mu.Unlock()
+
+		if err := st.session.write(muxFrame(muxData, 0, st.id, chunk, p[:chunk])); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+//Close half closes the stream: no more data can be written.
+func (st *MuxStream) Close() error {
+	st.mu.Lock()
+	if st.writeClosed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	done := st.readClosed
+	st.mu.Unlock()
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+	return st.session.write(muxFrame(muxWindowUpdate, muxFlagFIN, st.id, 0, nil))
+}
+
+//Reset aborts the stream in both directions.
+func (st *MuxStream) Reset() error {
+	st.mu.Lock()
+	if st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.reset = true
+	st.mu.Unlock()
+
+	st.session.removeStream(st.id)
+	notify(st.readReady)
+	notify(st.writeReady)
+	return st.session.write(muxFrame(muxWindowUpdate, muxFlagRST, st.id, 0, nil))
+}
+
+//receive reads length bytes of data for the stream from r.
+func (st *MuxStream) receive(r io.Reader, length uint32) error {
+	st.mu.Lock()
+	exceeded := length > st.recvWindow
+	st.mu.Unlock()
+	if exceeded {
+		return errors.New("socketman: mux: stream window exceeded")
+	}
+
+	p := make([]byte, length)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return err
+	}
+	// the window shrinks as the buffer grows, so
+	// Read never grants credit for bytes in flight.
+	st.mu.Lock()
+	st.recvWindow -= length
+	if !st.readClosed && !st.reset {
+		st.buf.Write(p)
+	}
+	st.mu.Unlock()
+	notify(st.readReady)
+	return nil
+}
+
+func (st *MuxStream) grow(delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	notify(st.writeReady)
+}
+
+func (st *MuxStream) handleFlags(flags uint16) {
+	switch {
+	case flags&muxFlagRST != 0:
+		st.mu.Lock()
+		st.reset = true
+		st.mu.Unlock()
+		st.session.removeStream(st.id)
+		notify(st.readReady)
+		notify(st.writeReady)
+	case flags&muxFlagFIN != 0:
+		st.mu.Lock()
+		st.readClosed = true
+		done := st.writeClosed
+		st.mu.Unlock()
+		if done {
+			st.session.removeStream(st.id)
+		}
+		notify(st.readReady)
+	}
+}
+
+//notify wakes up a goroutine waiting on ch, if any.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
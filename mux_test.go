@@ -0,0 +1,272 @@
+package socketman_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+	"github.com/azr/socketman/internal"
+)
+
+func TestMux(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs := map[string][2]socketman.Config{
+		"plain": {},
+		"tls+cypher": {
+			{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}, CypherPool: aespool},
+			{TLSConfig: &tls.Config{InsecureSkipVerify: true}, CypherPool: aespool},
+		},
+	}
+	// more than a stream window, so flow control kicks in.
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	for name, conf := range configs {
+		t.Run(name, func(t *testing.T) {
+			server := &socketman.Server{Config: conf[0]}
+			client := &socketman.Client{Config: conf[1]}
+			handler := socketman.MuxHandler(nil, socketman.HandlerFunc(echoHandler))
+			test(t, server, handler.ServeSocket, client, func(c io.ReadWriter) {
+				s := socketman.NewMuxSession(c, true, nil)
+				defer s.Close()
+				var wg sync.WaitGroup
+				for i := 0; i < 10; i++ {
+					st, err := s.OpenStream()
+					if err != nil {
+						t.Errorf("open failed: %s", err)
+						return
+					}
+					if st.ID()%2 != 1 {
+						t.Errorf("client stream ids should be odd, got %d", st.ID())
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						go func() {
+							st.Write(data)
+							st.Close() // half close: the echo can still come back
+						}()
+						echo, err := io.ReadAll(st)
+						if err != nil {
+							t.Errorf("read failed: %s", err)
+						}
+						if !bytes.Equal(echo, data) {
+							t.Errorf("expected %d bytes echoed, got %d", len(data), len(echo))
+						}
+					}()
+				}
+				wg.Wait()
+				if n := s.NumStreams(); n != 0 {
+					t.Errorf("closed streams should be released, %d left", n)
+				}
+			})
+		})
+	}
+}
+
+// muxPipe returns a client and a server session talking together.
+func muxPipe(config *socketman.MuxConfig) (*socketman.MuxSession, *socketman.MuxSession) {
+	c1, c2 := net.Pipe()
+	return socketman.NewMuxSession(c1, true, config), socketman.NewMuxSession(c2, false, config)
+}
+
+func TestMux_reset(t *testing.T) {
+	client, server := muxPipe(nil)
+	defer client.Close()
+	defer server.Close()
+	go server.Serve(socketman.HandlerFunc(func(c io.ReadWriter) {
+		c.Read(make([]byte, 1))
+		c.(*socketman.MuxStream).Reset()
+	}))
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Write([]byte("x"))
+	if _, err := st.Read(make([]byte, 1)); err != socketman.ErrStreamReset {
+		t.Fatalf("expected ErrStreamReset, got %v", err)
+	}
+	if _, err := st.Write([]byte("x")); err != socketman.ErrStreamReset {
+		t.Fatalf("expected ErrStreamReset writing, got %v", err)
+	}
+}
+
+func TestMux_panic(t *testing.T) {
+	client, server := muxPipe(nil)
+	defer client.Close()
+	defer server.Close()
+	go server.Serve(socketman.HandlerFunc(panicHandler))
+
+	for i := 0; i < 2; i++ {
+		st, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("session should survive a panic, open failed: %s", err)
+		}
+		if _, err := st.Read(make([]byte, 1)); err != socketman.ErrStreamReset {
+			t.Fatalf("expected ErrStreamReset, got %v", err)
+		}
+	}
+}
+
+func TestMux_serverOpens(t *testing.T) {
+	client, server := muxPipe(nil)
+	defer client.Close()
+	defer server.Close()
+	go client.Serve(socketman.HandlerFunc(echoHandler))
+
+	st, err := server.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ID()%2 != 0 {
+		t.Fatalf("server stream ids should be even, got %d", st.ID())
+	}
+	go func() {
+		io.WriteString(st, "hello")
+		st.Close()
+	}()
+	if echo, err := io.ReadAll(st); err != nil || string(echo) != "hello" {
+		t.Fatalf("expected hello echoed, got %q %v", echo, err)
+	}
+}
+
+func TestMux_closeWrite(t *testing.T) {
+	client, server := muxPipe(nil)
+	defer client.Close()
+	defer server.Close()
+	go server.Serve(socketman.HandlerFunc(func(c io.ReadWriter) {
+		b, _ := io.ReadAll(c)
+		// the client half closed, we can still answer.
+		c.Write(append(b, " world"...))
+	}))
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(st, "hello")
+	st.Close()
+	if _, err := st.Write([]byte("x")); err != socketman.ErrStreamClosed {
+		t.Fatalf("expected ErrStreamClosed writing after close, got %v", err)
+	}
+	if b, err := io.ReadAll(st); err != nil || string(b) != "hello world" {
+		t.Fatalf("expected answer after half close, got %q %v", b, err)
+	}
+}
+
+func TestMux_keepalive(t *testing.T) {
+	client, server := muxPipe(&socketman.MuxConfig{KeepAliveInterval: 10 * time.Millisecond})
+	defer server.Close()
+	rtt, err := client.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("expected a round trip time, got %s", rtt)
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-client.Done():
+		t.Fatal("healthy session should stay open")
+	default:
+	}
+	client.Close()
+
+	// a peer that never answers
+	c1, c2 := net.Pipe()
+	go io.Copy(io.Discard, c2)
+	s := socketman.NewMuxSession(c1, true, &socketman.MuxConfig{KeepAliveInterval: 10 * time.Millisecond})
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("session with a dead peer should be closed")
+	}
+	if _, err := s.AcceptStream(); err != socketman.ErrKeepAliveTimeout {
+		t.Fatalf("expected ErrKeepAliveTimeout, got %v", err)
+	}
+}
+
+func TestMux_goAway(t *testing.T) {
+	client, server := muxPipe(nil)
+	defer client.Close()
+	server.Close()
+	<-client.Done()
+	if _, err := client.OpenStream(); err != socketman.ErrSessionShutdown {
+		t.Fatalf("expected ErrSessionShutdown, got %v", err)
+	}
+	if err := client.Serve(socketman.HandlerFunc(echoHandler)); err != nil {
+		t.Fatalf("serve should return nil after a normal closure, got %s", err)
+	}
+}
+
+// rawFrame encodes a mux frame, see muxFrame.
+func rawFrame(typ byte, flags uint16, id, length uint32, payload []byte) []byte {
+	frame := make([]byte, 12, 12+len(payload))
+	frame[1] = typ
+	binary.BigEndian.PutUint16(frame[2:], flags)
+	binary.BigEndian.PutUint32(frame[4:], id)
+	binary.BigEndian.PutUint32(frame[8:], length)
+	return append(frame, payload...)
+}
+
+// TestMux_window checks a frame still being received is
+// not credited back to the peer when earlier data is read.
+func TestMux_window(t *testing.T) {
+	const window, half = 256 << 10, 128 << 10
+	peer, c := net.Pipe()
+	defer peer.Close()
+	server := socketman.NewMuxSession(c, false, nil)
+	defer server.Close()
+
+	updates := make(chan uint32, 10)
+	go func() {
+		hdr := make([]byte, 12)
+		for {
+			if _, err := io.ReadFull(peer, hdr); err != nil {
+				return
+			}
+			if length := binary.BigEndian.Uint32(hdr[8:]); hdr[1] == 1 && length > 0 {
+				updates <- length
+			}
+		}
+	}()
+	peer.Write(rawFrame(0, 1, 1, half, make([]byte, half)))
+	st, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second frame arrives in two parts.
+	peer.Write(rawFrame(0, 0, 1, half, make([]byte, half/2)))
+
+	if _, err := io.ReadFull(st, make([]byte, half)); err != nil {
+		t.Fatal(err)
+	}
+	var granted uint32
+	select {
+	case granted = <-updates:
+	case <-time.After(time.Second):
+		t.Fatal("no window update after reading half of the window")
+	}
+	if granted > half {
+		t.Fatalf("%d bytes read but %d credited: bytes in flight are counted twice", half, granted)
+	}
+
+	peer.Write(make([]byte, half/2))
+	if _, err := io.ReadFull(st, make([]byte, half)); err != nil {
+		t.Fatal(err)
+	}
+	if granted += <-updates; granted != window {
+		t.Fatalf("expected the whole window back once read, got %d", granted)
+	}
+}
@@ -0,0 +1,270 @@
+package socketman
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//ProtocolVersion is the version of the preamble
+//exchanged when Config.Negotiation is set.
+const ProtocolVersion = 1
+
+const (
+	preambleMagic = "SOCKETMAN/"
+
+	//preambleMaxSize bounds the preamble a peer can send.
+	preambleMaxSize = 4 << 10
+)
+
+//cypherCheck is encrypted by both ends, to check they
+//use the same CypherPool key. Only a hash of the result is
+//sent, not to give away the key stream.
+var cypherCheck = bytes.Repeat([]byte("socketman cypher check "), 4)
+
+//Negotiation configures the preamble ends exchange when connecting,
+//announcing their protocol version, encryption, compression and
+//framing. Connections fail with a *NegotiationError unless both ends
+//agree, instead of handlers reading garbage.
+//
+//Both ends must set it. A Server refuses clients not sending
+//a preamble; a Client waits for the preamble of servers
+//until HandshakeTimeout.
+type Negotiation struct {
+	//Framing, if set, is the framing handlers use with
+	//NewMessageConn, and must match the peer's.
+	Framing *Framing
+}
+
+//NegotiationError is returned when ends can't agree.
+type NegotiationError struct {
+	//Reason tells what they disagree on.
+	Reason string
+
+	//Remote is true if the peer refused the connection.
+	Remote bool
+}
+
+func (e *NegotiationError) Error() string {
+	if e.Remote {
+		return "socketman: negotiation refused by peer: " + e.Reason
+	}
+	return "socketman: negotiation failed: " + e.Reason
+}
+
+//preamble is sent by the client, and answered with one
+//holding the agreed parameters or an error.
+//
+//It's text: a "SOCKETMAN/<version>" line, "key: value"
+//lines and an empty line.
+type preamble struct {
+	version     int
+	cypher      string   // hex hash of the encrypted cypherCheck, or "none"
+	compression []string // offered, or chosen by the server
+	framing     string   // see describeFraming
+	err         string   // set by a server refusing
+}
+
+func (p *preamble) marshal() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s%d\n", preambleMagic, p.version)
+	if p.err != "" {
+		fmt.Fprintf(&b, "error: %s\n", p.err)
+	} else {
+		fmt.Fprintf(&b, "cypher: %s\n", p.cypher)
+		fmt.Fprintf(&b, "compression: %s\n", strings.Join(p.compression, ","))
+		fmt.Fprintf(&b, "framing: %s\n", p.framing)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+//readPreamble reads a preamble byte by byte, so
+//nothing sent after it is consumed.
+func readPreamble(r io.Reader) (*preamble, error) {
+	var (
+		buf  []byte
+		b    [1]byte
+		prev byte
+	)
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		if len(buf) < len(preambleMagic) && b[0] != preambleMagic[len(buf)] {
+			return nil, &NegotiationError{Reason: "peer did not send a preamble; is Negotiation set on both ends?"}
+		}
+		if b[0] == '\n' && prev == '\n' {
+			break
+		}
+		if len(buf) == preambleMaxSize {
+			return nil, &NegotiationError{Reason: "preamble too long"}
+		}
+		buf = append(buf, b[0])
+		prev = b[0]
+	}
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	version, err := strconv.Atoi(strings.TrimPrefix(lines[0], preambleMagic))
+	if err != nil || version < 1 {
+		return nil, &NegotiationError{Reason: "invalid version " + lines[0]}
+	}
+	p := &preamble{version: version}
+	for _, line := range lines[1:] {
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			return nil, errors.New("socketman: malformed preamble line " + line)
+		}
+		value := line[i+2:]
+		switch line[:i] {
+		case "cypher":
+			p.cypher = value
+		case "compression":
+			if value != "" {
+				p.compression = strings.Split(value, ",")
+			}
+		case "framing":
+			p.framing = value
+		case "error":
+			p.err = value
+		}
+		// unknown keys are from newer versions
+	}
+	return p, nil
+}
+
+//localPreamble describes what c uses.
+func (c *Config) localPreamble() *preamble {
+	p := &preamble{
+		version: ProtocolVersion,
+		cypher:  "none",
+		framing: describeFraming(c.Negotiation.Framing),
+	}
+	if c.CypherPool != nil {
+		var b bytes.Buffer
+		if w := c.CypherPool.Writer(&b); w != nil {
+			w.Write(cypherCheck)
+			sum := sha256.Sum256(b.Bytes())
+			p.cypher = hex.EncodeToString(sum[:])
+		}
+	}
+	for _, comp := range c.Compressors {
+		p.compression = append(p.compression, comp.Name())
+	}
+	return p
+}
+
+//describeFraming tells what of f makes the wire format.
+func describeFraming(f *Framing) string {
+	if f == nil {
+		return "none"
+	}
+	desc := "uvarint"
+	if f.FixedLength {
+		desc = "fixed32"
+	}
+	desc += " max=" + strconv.Itoa(f.maxMessageSize())
+	if f.Heartbeat != nil {
+		desc += " heartbeat"
+	}
+	return desc
+}
+
+//disagreement returns why local and remote can't talk,
+//if they can't.
+func disagreement(local, remote *preamble) string {
+	switch {
+	case local.cypher == "none" && remote.cypher != "none":
+		return "peer encrypts with a CypherPool, this end does not"
+	case local.cypher != "none" && remote.cypher == "none":
+		return "this end encrypts with a CypherPool, peer does not"
+	case local.cypher != remote.cypher:
+		return "CypherPool keys differ"
+	case local.framing != remote.framing:
+		return fmt.Sprintf("framing differs: %s here, %s for peer", local.framing, remote.framing)
+	}
+	return ""
+}
+
+//negotiate runs the preamble exchange on rw if c.Negotiation is
+//set, or only negotiates compression, and returns the compressor
+//to use, if any.
+func (c *Config) negotiate(rw io.ReadWriter, client bool) (Compressor, error) {
+	if c.Negotiation == nil {
+		if client {
+			return offerCompression(rw, c.Compressors)
+		}
+		return acceptCompression(rw, c.Compressors)
+	}
+	local := c.localPreamble()
+	if client {
+		return c.offerPreamble(rw, local)
+	}
+	return c.acceptPreamble(rw, local)
+}
+
+func (c *Config) offerPreamble(rw io.ReadWriter, local *preamble) (Compressor, error) {
+	if _, err := rw.Write(local.marshal()); err != nil {
+		return nil, err
+	}
+	answer, err := readPreamble(rw)
+	if err != nil {
+		return nil, err
+	}
+	if answer.err != "" {
+		return nil, &NegotiationError{Reason: answer.err, Remote: true}
+	}
+	if answer.version > local.version {
+		return nil, &NegotiationError{Reason: "peer chose unsupported version " + strconv.Itoa(answer.version)}
+	}
+	if reason := disagreement(local, answer); reason != "" {
+		return nil, &NegotiationError{Reason: reason}
+	}
+	if len(answer.compression) == 0 {
+		return nil, nil
+	}
+	for _, comp := range c.Compressors {
+		if comp.Name() == answer.compression[0] {
+			return comp, nil
+		}
+	}
+	return nil, &NegotiationError{Reason: "peer chose unknown compression " + answer.compression[0]}
+}
+
+func (c *Config) acceptPreamble(rw io.ReadWriter, local *preamble) (Compressor, error) {
+	offer, err := readPreamble(rw)
+	if err != nil {
+		return nil, err
+	}
+	answer := &preamble{
+		version: local.version,
+		cypher:  local.cypher,
+		framing: local.framing,
+	}
+	if offer.version < answer.version {
+		answer.version = offer.version
+	}
+	if reason := disagreement(local, offer); reason != "" {
+		// the client gets it from its own point of view.
+		refusal := &preamble{version: answer.version, err: disagreement(offer, local)}
+		rw.Write(refusal.marshal())
+		return nil, &NegotiationError{Reason: reason}
+	}
+	var chosen Compressor
+	for _, comp := range c.Compressors {
+		for _, name := range offer.compression {
+			if chosen == nil && comp.Name() == name {
+				chosen = comp
+				answer.compression = []string{name}
+			}
+		}
+	}
+	if _, err := rw.Write(answer.marshal()); err != nil {
+		return nil, err
+	}
+	return chosen, nil
+}
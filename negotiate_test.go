@@ -0,0 +1,102 @@
+package socketman_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+)
+
+func TestNegotiation(t *testing.T) {
+	framing := &socketman.Framing{FixedLength: true}
+	config := socketman.Config{
+		Negotiation: &socketman.Negotiation{Framing: framing},
+		CypherPool:  aespool,
+		Compressors: []socketman.Compressor{socketman.DeflateCompressor{}},
+	}
+	testEchoServer(t, &socketman.Server{Config: config}, &socketman.Client{Config: config})
+
+	var msg []byte
+	test(t, &socketman.Server{Config: config}, func(c io.ReadWriter) {
+		socketman.NewMessageConn(c, *framing).WriteMessage([]byte("framed"))
+	}, &socketman.Client{Config: config}, func(c io.ReadWriter) {
+		msg, _ = socketman.NewMessageConn(c, *framing).ReadMessage()
+	})
+	if string(msg) != "framed" {
+		t.Fatalf("expected a framed message, got %q", msg)
+	}
+}
+
+func TestNegotiation_mismatch(t *testing.T) {
+	otherpool, err := socketman.NewAESPool([]byte("another key 1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	negotiation := &socketman.Negotiation{}
+	tests := map[string]struct {
+		server, client socketman.Config
+		reason         string
+	}{
+		"cypher on server only": {
+			server: socketman.Config{Negotiation: negotiation, CypherPool: aespool},
+			client: socketman.Config{Negotiation: negotiation},
+			reason: "peer encrypts with a CypherPool, this end does not",
+		},
+		"cypher on client only": {
+			server: socketman.Config{Negotiation: negotiation},
+			client: socketman.Config{Negotiation: negotiation, CypherPool: aespool},
+			reason: "this end encrypts with a CypherPool, peer does not",
+		},
+		"cypher keys": {
+			server: socketman.Config{Negotiation: negotiation, CypherPool: aespool},
+			client: socketman.Config{Negotiation: negotiation, CypherPool: otherpool},
+			reason: "CypherPool keys differ",
+		},
+		"framing": {
+			server: socketman.Config{Negotiation: &socketman.Negotiation{Framing: &socketman.Framing{FixedLength: true}}},
+			client: socketman.Config{Negotiation: &socketman.Negotiation{Framing: &socketman.Framing{}}},
+			reason: "framing differs",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := &socketman.Server{Config: tt.server}
+			done := make(chan error, 1)
+			go func() { done <- server.ListenAndServeFunc(addr, echoHandler) }()
+			defer func() {
+				server.Close()
+				<-done
+			}()
+			time.Sleep(10 * time.Millisecond)
+
+			client := &socketman.Client{Config: tt.client}
+			err := client.ConnectFunc(addr, func(c io.ReadWriter) {
+				t.Error("handler should not run")
+			})
+			var ne *socketman.NegotiationError
+			if !errors.As(err, &ne) {
+				t.Fatalf("expected a *NegotiationError, got %v", err)
+			}
+			if !ne.Remote || !strings.HasPrefix(ne.Reason, tt.reason) {
+				t.Fatalf("expected the server to refuse with %q, got %v", tt.reason, err)
+			}
+		})
+	}
+}
+
+func TestNegotiation_noPreamble(t *testing.T) {
+	server := &socketman.Server{Config: socketman.Config{Negotiation: &socketman.Negotiation{}}}
+	var err error
+	test(t, server, func(c io.ReadWriter) {
+		t.Error("handler should not run")
+	}, &socketman.Client{}, func(c io.ReadWriter) {
+		io.WriteString(c, "hello, world!")
+		_, err = c.Read(make([]byte, 1))
+	})
+	if err == nil {
+		t.Fatal("server should hang up on clients not sending a preamble")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package socketman
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCred(c *net.UnixConn) (*PeerCred, error) {
+	return nil, errors.New("socketman: peer credentials are not supported on this platform")
+}
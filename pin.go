@@ -0,0 +1,119 @@
+package socketman
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//SPKIPin returns the pin of the public key of cert,
+//"sha256/" followed by the base64 SHA-256 of its
+//Subject Public Key Info, like curl and HPKP pins.
+//
+//	openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der |
+//		openssl dgst -sha256 -binary | base64
+//
+//prints it without the "sha256/" prefix.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+//PinError is returned when no certificate of
+//a server matches the Pins of a Client.
+type PinError struct {
+	//Pins are the pins of the certificates that
+	//were matched, leaf first.
+	Pins []string
+	//Expected are the Pins of the Client.
+	Expected []string
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("socketman: server certificate pins %s match none of %s",
+		strings.Join(e.Pins, ", "), strings.Join(e.Expected, ", "))
+}
+
+//verifyPeer sets up config, a copy, to check
+//Pins and IgnoreHostname.
+func (c *Client) verifyPeer(config *tls.Config) {
+	if len(c.Pins) == 0 && !c.IgnoreHostname {
+		return
+	}
+	verifyChain := c.IgnoreHostname && !config.InsecureSkipVerify
+	if c.IgnoreHostname {
+		// verified below, without host name
+		config.InsecureSkipVerify = true
+	}
+	next := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		chains := cs.VerifiedChains
+		if verifyChain {
+			var err error
+			if chains, err = verifyChainOnly(config, cs.PeerCertificates); err != nil {
+				return err
+			}
+		}
+		if err := c.checkPins(chains, cs.PeerCertificates); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(cs)
+		}
+		return nil
+	}
+}
+
+//verifyChainOnly verifies the chain of certs against
+//config.RootCAs, like tls does, but not the host name.
+func verifyChainOnly(config *tls.Config, certs []*x509.Certificate) ([][]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("socketman: server presented no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         config.RootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	if config.Time != nil {
+		opts.CurrentTime = config.Time()
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	return certs[0].Verify(opts)
+}
+
+//checkPins checks one of the certificates of the verified chains
+//matches Pins. Without verified chains only the leaf of certs is
+//matched: other certificates sent prove nothing.
+func (c *Client) checkPins(chains [][]*x509.Certificate, certs []*x509.Certificate) error {
+	if len(c.Pins) == 0 {
+		return nil
+	}
+	var candidates []*x509.Certificate
+	for _, chain := range chains {
+		candidates = append(candidates, chain...)
+	}
+	if len(chains) == 0 && len(certs) > 0 {
+		candidates = certs[:1]
+	}
+	err := &PinError{Expected: c.Pins}
+	seen := map[string]bool{}
+	for _, cert := range candidates {
+		pin := SPKIPin(cert)
+		for _, expected := range c.Pins {
+			if pin == expected {
+				return nil
+			}
+		}
+		if !seen[pin] {
+			seen[pin] = true
+			err.Pins = append(err.Pins, pin)
+		}
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package socketman_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/azr/socketman"
+)
+
+func TestPins(t *testing.T) {
+	cert, other := selfSigned(t, "server.example.org"), selfSigned(t, "other.example.org")
+	server := &socketman.Server{Config: socketman.Config{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}}}
+	defer serve(t, server, named("ok", 0))()
+	pin, otherPin := socketman.SPKIPin(cert.Leaf), socketman.SPKIPin(other.Leaf)
+
+	// result is "ok", "pin" for a *PinError or
+	// "verify" for a chain verification error.
+	tests := map[string]struct {
+		client *socketman.Client
+		pins   []string
+		result string
+	}{
+		"pin only":            {vhostClient("server.example.org", nil), []string{otherPin, pin}, "ok"},
+		"pin only, mismatch":  {vhostClient("server.example.org", nil), []string{otherPin}, "pin"},
+		"verified chain":      {vhostClient("server.example.org", &cert), []string{pin}, "ok"},
+		"verified, mismatch":  {vhostClient("server.example.org", &cert), []string{otherPin}, "pin"},
+		"unverifiable chain":  {vhostClient("server.example.org", &other), []string{pin}, "verify"},
+		"no pins, unverified": {vhostClient("server.example.org", &other), nil, "verify"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			tt.client.Pins = tt.pins
+			var answer []byte
+			err := tt.client.ConnectFunc(addr, func(c io.ReadWriter) {
+				answer, _ = io.ReadAll(c)
+			})
+			var pinErr *socketman.PinError
+			switch {
+			case tt.result == "ok":
+				if err != nil || string(answer) != "ok:" {
+					t.Fatalf("expected to connect, got %q, %v", answer, err)
+				}
+			case err == nil:
+				t.Fatal("expected to fail")
+			case errors.As(err, &pinErr) != (tt.result == "pin"):
+				t.Fatalf("expected a %s error, got %v", tt.result, err)
+			case pinErr != nil && !reflect.DeepEqual(pinErr.Pins, []string{pin}):
+				t.Fatalf("expected the server pin in %v", err)
+			}
+		})
+	}
+}
+
+func TestIgnoreHostname(t *testing.T) {
+	cert, other := selfSigned(t, "server.example.org"), selfSigned(t, "server.example.org")
+	server := &socketman.Server{Config: socketman.Config{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}}}
+	defer serve(t, server, named("ok", 0))()
+
+	// addr is an IP address, the certificate lists none.
+	client := vhostClient("", &cert)
+	if connects(client) {
+		t.Fatal("host name should be verified by default")
+	}
+	client.IgnoreHostname = true
+	if !connects(client) {
+		t.Fatal("chain should be enough when ignoring host names")
+	}
+	client.Pins = []string{socketman.SPKIPin(other.Leaf)}
+	if connects(client) {
+		t.Fatal("pins should still be checked")
+	}
+	if connects(&socketman.Client{IgnoreHostname: true, Config: vhostClient("", &other).Config}) {
+		t.Fatal("chain should still be verified when ignoring host names")
+	}
+}
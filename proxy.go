@@ -0,0 +1,104 @@
+package socketman
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+//dialer returns the dialer opening raw connections for c.
+//
+//If c.Proxy is set, connections are tunneled through it.
+func (c *Client) dialer() (proxy.Dialer, error) {
+	var direct proxy.Dialer = &net.Dialer{
+		Timeout:   c.Config.HandshakeTimeout,
+		Control:   c.Config.TCP.control,
+		KeepAlive: -1, // set with other options after dial
+	}
+	if c.Config.HandshakeTimeout > 0 {
+		direct = deadlineDialer{Dialer: direct, timeout: c.Config.HandshakeTimeout}
+	}
+	if c.Proxy == nil {
+		return direct, nil
+	}
+	switch c.Proxy.Scheme {
+	case "socks5", "socks5h":
+		return proxy.FromURL(c.Proxy, direct)
+	case "http":
+		return &httpConnectDialer{proxy: c.Proxy, forward: direct}, nil
+	}
+	return nil, fmt.Errorf("socketman: unsupported proxy scheme %q", c.Proxy.Scheme)
+}
+
+//deadlineDialer sets a deadline on connections once dialed,
+//bounding proxy handshakes too; newconn clears it.
+type deadlineDialer struct {
+	proxy.Dialer
+	timeout time.Duration
+}
+
+func (d deadlineDialer) Dial(network, addr string) (net.Conn, error) {
+	deadline := time.Now().Add(d.timeout)
+	c, err := d.Dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(deadline)
+	return c, nil
+}
+
+//httpConnectDialer opens tunnels using the HTTP CONNECT method.
+type httpConnectDialer struct {
+	proxy   *url.URL
+	forward proxy.Dialer
+}
+
+//Dial asks the proxy to open a tunnel to addr.
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(d.proxy.Hostname(), "80")
+	}
+	c, err := d.forward.Dial(network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.proxy.User; u != nil {
+		password, _ := u.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("socketman: proxy %s refused tunnel to %s: %s", proxyAddr, addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// server spoke first, don't lose what was read.
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
@@ -0,0 +1,234 @@
+package socketman_test
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+	"github.com/azr/socketman/internal"
+)
+
+// pipe copies data between a and b until one side is done.
+func pipe(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// socks5Proxy starts a SOCKS5 proxy requiring username/password
+// authentication. tunnels counts opened tunnels.
+func socks5Proxy(t *testing.T, user, password string, tunnels *int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				// greeting
+				buf := make([]byte, 255)
+				if _, err := io.ReadFull(c, buf[:2]); err != nil || buf[0] != 5 {
+					return
+				}
+				if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+					return
+				}
+				c.Write([]byte{5, 2}) // username/password please
+				// RFC 1929 auth
+				if _, err := io.ReadFull(c, buf[:2]); err != nil {
+					return
+				}
+				u := make([]byte, buf[1])
+				io.ReadFull(c, u)
+				io.ReadFull(c, buf[:1])
+				p := make([]byte, buf[0])
+				io.ReadFull(c, p)
+				if string(u) != user || string(p) != password {
+					c.Write([]byte{1, 1})
+					return
+				}
+				c.Write([]byte{1, 0})
+				// connect request
+				if _, err := io.ReadFull(c, buf[:4]); err != nil || buf[1] != 1 {
+					return
+				}
+				var host string
+				switch buf[3] {
+				case 1:
+					io.ReadFull(c, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					io.ReadFull(c, buf[:1])
+					name := make([]byte, buf[0])
+					io.ReadFull(c, name)
+					host = string(name)
+				default:
+					return
+				}
+				var port uint16
+				binary.Read(c, binary.BigEndian, &port)
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+				if err != nil {
+					c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				atomic.AddInt32(tunnels, 1)
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				pipe(c, target)
+			}()
+		}
+	}()
+	return l
+}
+
+// connectProxy starts an HTTP CONNECT proxy requiring basic
+// authentication. tunnels counts opened tunnels.
+func connectProxy(t *testing.T, user, password string, tunnels *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		req := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+		u, p, ok := req.BasicAuth()
+		if !ok || u != user || p != password {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack failed: %s", err)
+			return
+		}
+		atomic.AddInt32(tunnels, 1)
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		pipe(c, target)
+	}))
+}
+
+func testProxy(t *testing.T, proxyURL *url.URL, tunnels *int32) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &socketman.Server{
+		Config: socketman.Config{
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+			CypherPool: aespool,
+		},
+	}
+	client := &socketman.Client{
+		Config: socketman.Config{
+			TLSConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			CypherPool: aespool,
+		},
+		Proxy: proxyURL,
+	}
+
+	testEchoServer(t, server, client)
+	if n := atomic.LoadInt32(tunnels); n != 1 {
+		t.Fatalf("expected one tunnel through proxy, got %d", n)
+	}
+
+	wrong := *proxyURL
+	wrong.User = url.UserPassword("socketman", "wrong")
+	client.Proxy = &wrong
+	if err := client.ConnectFunc(addr, echoHandler); err == nil {
+		t.Fatal("proxy should have refused wrong credentials")
+	}
+}
+
+func TestProxy_socks5(t *testing.T) {
+	var tunnels int32
+	l := socks5Proxy(t, "socketman", "secret", &tunnels)
+	defer l.Close()
+
+	testProxy(t, &url.URL{
+		Scheme: "socks5",
+		User:   url.UserPassword("socketman", "secret"),
+		Host:   l.Addr().String(),
+	}, &tunnels)
+}
+
+func TestProxy_httpConnect(t *testing.T) {
+	var tunnels int32
+	proxy := connectProxy(t, "socketman", "secret", &tunnels)
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL.User = url.UserPassword("socketman", "secret")
+	testProxy(t, proxyURL, &tunnels)
+}
+
+func TestProxy_unsupportedScheme(t *testing.T) {
+	client := &socketman.Client{
+		Proxy: &url.URL{Scheme: "ftp", Host: "127.0.0.1:21"},
+	}
+	if err := client.ConnectFunc(addr, echoHandler); err == nil {
+		t.Fatal("ftp proxies should not be supported")
+	}
+}
+
+func TestProxy_stalled(t *testing.T) {
+	// accepts tunnels and never answers.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	for _, scheme := range []string{"socks5", "http"} {
+		client := &socketman.Client{
+			Config: socketman.Config{HandshakeTimeout: 100 * time.Millisecond},
+			Proxy:  &url.URL{Scheme: scheme, Host: l.Addr().String()},
+		}
+		done := make(chan error, 1)
+		go func() { done <- client.ConnectFunc(addr, echoHandler) }()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("%s: a stalled proxy should fail connecting", scheme)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: HandshakeTimeout should bound the proxy handshake", scheme)
+		}
+	}
+}
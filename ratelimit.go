@@ -0,0 +1,175 @@
+package socketman
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//RateLimit throttles the bandwidth of connections.
+//
+//Limits are in bytes per second of data handlers
+//read and write; zero means unlimited.
+type RateLimit struct {
+	//Read and Write limit each connection.
+	//They can be changed at runtime with ConnRateLimiters.
+	Read, Write int
+
+	//GlobalRead and GlobalWrite, if set, are shared by all
+	//connections using this Config, like those of a Server
+	//or a Client.
+	GlobalRead, GlobalWrite *RateLimiter
+}
+
+//RateLimiter is a token bucket limiting a number of bytes per
+//second. It's safe for concurrent use and can be shared by
+//connections.
+//
+//A nil or zero RateLimiter does not limit.
+type RateLimiter struct {
+	throttled int64 // nanoseconds waited; first for atomic alignment
+	limited   int32 // 1 when rate > 0, checked without locking
+
+	mu     sync.Mutex // guards fields below
+	rate   int
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+//NewRateLimiter returns a RateLimiter allowing bytesPerSecond,
+//with bursts of up to burst bytes. A burst <= 0 is one second
+//worth of bytes; a bytesPerSecond <= 0 does not limit.
+func NewRateLimiter(bytesPerSecond, burst int) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(bytesPerSecond, burst)
+	return l
+}
+
+//SetRate changes the limit, see NewRateLimiter.
+//Bytes already waited for are not affected.
+func (l *RateLimiter) SetRate(bytesPerSecond, burst int) {
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.refill(now)
+	if l.rate <= 0 {
+		// was unlimited: start full
+		l.tokens = float64(burst)
+	}
+	l.rate, l.burst = bytesPerSecond, burst
+	if l.tokens > float64(burst) {
+		l.tokens = float64(burst)
+	}
+	l.last = now
+	if bytesPerSecond > 0 {
+		atomic.StoreInt32(&l.limited, 1)
+	} else {
+		atomic.StoreInt32(&l.limited, 0)
+	}
+}
+
+//Rate returns the current limit.
+func (l *RateLimiter) Rate() (bytesPerSecond, burst int) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate, l.burst
+}
+
+//Throttled returns the total time I/O waited for l.
+func (l *RateLimiter) Throttled() time.Duration {
+	if l == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&l.throttled))
+}
+
+func (l *RateLimiter) isLimited() bool {
+	return l != nil && atomic.LoadInt32(&l.limited) == 1
+}
+
+//refill adds tokens earned since l.last; l.mu must be held.
+func (l *RateLimiter) refill(now time.Time) {
+	if l.rate <= 0 {
+		return
+	}
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+}
+
+//reserve takes n tokens and returns how long to wait
+//before they are available.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	if !l.isLimited() {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	wait := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	atomic.AddInt64(&l.throttled, int64(wait))
+	return wait
+}
+
+//chunk returns the size I/O on l should be split at.
+func (l *RateLimiter) chunk(n int) int {
+	if !l.isLimited() {
+		return n
+	}
+	_, burst := l.Rate()
+	if burst > 0 && n > burst {
+		return burst
+	}
+	return n
+}
+
+//ConnRateLimiters returns the per connection read and write
+//limiters of rw, as handed to a Handler, so they can be
+//changed at runtime or their Throttled metric read.
+//ok is false if rw is not a socketman connection.
+func ConnRateLimiters(rw io.ReadWriter) (read, write *RateLimiter, ok bool) {
+	c, ok := connOf(rw)
+	if !ok {
+		return nil, nil, false
+	}
+	return c.readLimit, c.writeLimit, true
+}
+
+//throttle waits for n bytes on limiters, or until c is closed.
+func (c *conn) throttle(n int, limiters ...*RateLimiter) error {
+	var wait time.Duration
+	for _, l := range limiters {
+		if d := l.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-c.done:
+		return net.ErrClosed
+	}
+}
@@ -0,0 +1,144 @@
+package socketman_test
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+)
+
+const testRate = 100 << 10 // bytes per second
+
+// data takes about half a second past the initial burst.
+var throttledData = make([]byte, testRate+testRate/2)
+
+func TestRateLimit_write(t *testing.T) {
+	var (
+		took    time.Duration
+		limiter *socketman.RateLimiter
+	)
+	client := &socketman.Client{Config: socketman.Config{RateLimit: socketman.RateLimit{Write: testRate}}}
+	test(t, &socketman.Server{}, func(c io.ReadWriter) {
+		io.Copy(io.Discard, c)
+	}, client, func(c io.ReadWriter) {
+		_, limiter, _ = socketman.ConnRateLimiters(c)
+		start := time.Now()
+		if _, err := c.Write(throttledData); err != nil {
+			t.Errorf("write failed: %s", err)
+		}
+		took = time.Since(start)
+	})
+	if took < 400*time.Millisecond {
+		t.Fatalf("write should have been throttled, took %s", took)
+	}
+	if limiter.Throttled() < 400*time.Millisecond {
+		t.Fatalf("expected throttled time to be reported, got %s", limiter.Throttled())
+	}
+}
+
+func TestRateLimit_read(t *testing.T) {
+	var (
+		took time.Duration
+		read []byte
+	)
+	server := &socketman.Server{Config: socketman.Config{RateLimit: socketman.RateLimit{Read: testRate}}}
+	test(t, server, func(c io.ReadWriter) {
+		start := time.Now()
+		read, _ = io.ReadAll(io.LimitReader(c, int64(len(throttledData))))
+		took = time.Since(start)
+	}, &socketman.Client{}, func(c io.ReadWriter) {
+		c.Write(throttledData)
+		c.Read(make([]byte, 1)) // until the server is done
+	})
+	if !bytes.Equal(read, throttledData) {
+		t.Fatalf("expected %d bytes, got %d", len(throttledData), len(read))
+	}
+	if took < 400*time.Millisecond {
+		t.Fatalf("read should have been throttled, took %s", took)
+	}
+}
+
+func TestRateLimit_global(t *testing.T) {
+	global := socketman.NewRateLimiter(testRate, 0)
+	server := &socketman.Server{}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServeFunc(addr, func(c io.ReadWriter) {
+			io.Copy(io.Discard, c)
+		})
+	}()
+	defer func() {
+		server.Close()
+		<-done
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// each connection is below the limit, not both.
+	client := &socketman.Client{Config: socketman.Config{RateLimit: socketman.RateLimit{GlobalWrite: global}}}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := client.ConnectFunc(addr, func(c io.ReadWriter) {
+				if _, err := c.Write(throttledData[:len(throttledData)/2]); err != nil {
+					t.Errorf("write failed: %s", err)
+				}
+			})
+			if err != nil {
+				t.Errorf("connect failed: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if took := time.Since(start); took < 400*time.Millisecond {
+		t.Fatalf("connections should share the limit, took %s", took)
+	}
+	if global.Throttled() == 0 {
+		t.Fatal("expected throttled time to be reported")
+	}
+}
+
+func TestRateLimit_setRate(t *testing.T) {
+	var took time.Duration
+	client := &socketman.Client{Config: socketman.Config{RateLimit: socketman.RateLimit{Write: 1 << 10}}}
+	test(t, &socketman.Server{}, func(c io.ReadWriter) {
+		io.Copy(io.Discard, c)
+	}, client, func(c io.ReadWriter) {
+		_, limiter, ok := socketman.ConnRateLimiters(c)
+		if !ok {
+			t.Error("expected the limiters of a socketman connection")
+			return
+		}
+		if r, burst := limiter.Rate(); r != 1<<10 || burst != 1<<10 {
+			t.Errorf("expected a rate of 1KB/s with a 1KB burst, got %d/s with %d", r, burst)
+		}
+		limiter.SetRate(0, 0)
+		start := time.Now()
+		c.Write(throttledData)
+		took = time.Since(start)
+	})
+	if took > 200*time.Millisecond {
+		t.Fatalf("lifting the limit should take effect at once, took %s", took)
+	}
+}
+
+func TestRateLimit_close(t *testing.T) {
+	var err error
+	test(t, &socketman.Server{}, func(c io.ReadWriter) {
+		io.Copy(io.Discard, c)
+	}, &socketman.Client{Config: socketman.Config{RateLimit: socketman.RateLimit{Write: 1 << 10}}}, func(c io.ReadWriter) {
+		time.AfterFunc(50*time.Millisecond, func() {
+			c.(io.Closer).Close()
+		})
+		// would take a minute.
+		_, err = c.Write(make([]byte, 60<<10))
+	})
+	if err == nil {
+		t.Fatal("closing should interrupt a throttled write")
+	}
+}
@@ -0,0 +1,139 @@
+package socketman
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+//A Resolver turns the address given to Client.Connect into
+//a list of "host:port" addresses to dial.
+//Addresses are tried in order until one of them answers.
+type Resolver interface {
+	Resolve(ctx context.Context, addr string) ([]string, error)
+}
+
+//StaticResolver resolves addresses from a fixed table.
+//It is mostly useful for tests.
+//Unknown addresses are returned as is.
+type StaticResolver map[string][]string
+
+//Resolve returns the addresses registered for addr.
+func (r StaticResolver) Resolve(ctx context.Context, addr string) ([]string, error) {
+	if addrs, found := r[addr]; found {
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("socketman: no address registered for %s", addr)
+		}
+		return addrs, nil
+	}
+	return []string{addr}, nil
+}
+
+//SRVResolver resolves addresses using DNS SRV records.
+//
+//The address given to Resolve is the domain name to look up.
+//If Service and Proto are set, the name looked up is
+//_service._proto.addr as described in RFC 2782, otherwise addr
+//is looked up directly.
+//
+//Targets are ordered by priority, then randomly by weight
+//within a same priority.
+type SRVResolver struct {
+	Service string
+	Proto   string
+
+	//Resolver is used for lookups.
+	//If nil net.DefaultResolver will be used.
+	Resolver *net.Resolver
+}
+
+//Resolve looks up SRV records for addr.
+func (r *SRVResolver) Resolve(ctx context.Context, addr string) ([]string, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, records, err := resolver.LookupSRV(ctx, r.Service, r.Proto, addr)
+	if err != nil {
+		return nil, err
+	}
+	records = orderSRV(records, rand.Intn)
+	addrs := make([]string, 0, len(records))
+	for _, srv := range records {
+		target := strings.TrimSuffix(srv.Target, ".")
+		if target == "" {
+			// "." means service is decidedly not available
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(srv.Port))))
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("socketman: no SRV target available for " + addr)
+	}
+	return addrs, nil
+}
+
+//srvDomain returns name without its "_service._proto."
+//prefix, if any.
+func srvDomain(name string) string {
+	labels := strings.SplitN(name, ".", 3)
+	if len(labels) == 3 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_") {
+		return labels[2]
+	}
+	return name
+}
+
+//orderSRV sorts records by ascending priority and shuffles records of
+//a same priority using the weighted selection of RFC 2782.
+//intn is the source of randomness.
+func orderSRV(records []*net.SRV, intn func(int) int) []*net.SRV {
+	sorted := make([]*net.SRV, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+	for i := 0; i < len(sorted); {
+		j := i + 1
+		for j < len(sorted) && sorted[j].Priority == sorted[i].Priority {
+			j++
+		}
+		shuffleByWeight(sorted[i:j], intn)
+		i = j
+	}
+	return sorted
+}
+
+//shuffleByWeight orders records of a same priority.
+//Each round a record is picked with a probability proportional to its
+//weight; zero weight records only have a small chance of being picked
+//first.
+func shuffleByWeight(records []*net.SRV, intn func(int) int) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Weight == 0 && records[j].Weight != 0
+	})
+	sum := 0
+	for _, srv := range records {
+		sum += int(srv.Weight)
+	}
+	for len(records) > 1 {
+		if sum == 0 {
+			return // keep order
+		}
+		s := intn(sum + 1)
+		for i, srv := range records {
+			s -= int(srv.Weight)
+			if s <= 0 {
+				records[0], records[i] = records[i], records[0]
+				break
+			}
+		}
+		sum -= int(records[0].Weight)
+		records = records[1:]
+	}
+}
@@ -0,0 +1,155 @@
+package socketman_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/azr/socketman"
+)
+
+// dnsStub returns a resolver answering SRV questions with records
+// using an in process DNS server: no packet leaves the process.
+func dnsStub(t *testing.T, records []dnsmessage.SRVResource) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go serveDNS(t, server, records)
+			return client, nil
+		},
+	}
+}
+
+// serveDNS answers DNS over stream connection c.
+func serveDNS(t *testing.T, c net.Conn, records []dnsmessage.SRVResource) {
+	defer c.Close()
+	for {
+		var l uint16
+		if err := binary.Read(c, binary.BigEndian, &l); err != nil {
+			return
+		}
+		req := make([]byte, l)
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(req)
+		if err != nil {
+			t.Errorf("dns stub: %s", err)
+			return
+		}
+		q, err := p.Question()
+		if err != nil {
+			t.Errorf("dns stub: %s", err)
+			return
+		}
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+			ID:            h.ID,
+			Response:      true,
+			Authoritative: true,
+		})
+		b.EnableCompression()
+		b.StartQuestions()
+		b.Question(q)
+		b.StartAnswers()
+		if q.Type == dnsmessage.TypeSRV {
+			for _, srv := range records {
+				b.SRVResource(dnsmessage.ResourceHeader{
+					Name:  q.Name,
+					Type:  dnsmessage.TypeSRV,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				}, srv)
+			}
+		}
+		resp, err := b.Finish()
+		if err != nil {
+			t.Errorf("dns stub: %s", err)
+			return
+		}
+		binary.Write(c, binary.BigEndian, uint16(len(resp)))
+		c.Write(resp)
+	}
+}
+
+func TestSRVResolver_priority(t *testing.T) {
+	resolver := &socketman.SRVResolver{
+		Service: "socketman",
+		Proto:   "tcp",
+		Resolver: dnsStub(t, []dnsmessage.SRVResource{
+			{Priority: 20, Weight: 1, Port: 2, Target: dnsmessage.MustNewName("b.example.com.")},
+			{Priority: 30, Weight: 1, Port: 3, Target: dnsmessage.MustNewName("c.example.com.")},
+			{Priority: 10, Weight: 1, Port: 1, Target: dnsmessage.MustNewName("a.example.com.")},
+		}),
+	}
+	addrs, err := resolver.Resolve(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a.example.com:1", "b.example.com:2", "c.example.com:3"}
+	if len(addrs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, addrs)
+	}
+	for i := range expected {
+		if addrs[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, addrs)
+		}
+	}
+}
+
+func TestSRVResolver_weight(t *testing.T) {
+	resolver := &socketman.SRVResolver{
+		Resolver: dnsStub(t, []dnsmessage.SRVResource{
+			{Priority: 10, Weight: 1, Port: 1, Target: dnsmessage.MustNewName("light.example.com.")},
+			{Priority: 10, Weight: 99, Port: 2, Target: dnsmessage.MustNewName("heavy.example.com.")},
+		}),
+	}
+	heavy := 0
+	for i := 0; i < 200; i++ {
+		addrs, err := resolver.Resolve(context.Background(), "_socketman._tcp.example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 2 {
+			t.Fatalf("expected two addresses, got %v", addrs)
+		}
+		if addrs[0] == "heavy.example.com:2" {
+			heavy++
+		}
+	}
+	if heavy < 150 {
+		t.Fatalf("heavy target should mostly come first, came first %d/200 times", heavy)
+	}
+}
+
+func TestSRVResolver_connect(t *testing.T) {
+	client := &socketman.Client{
+		Resolver: &socketman.SRVResolver{
+			Resolver: dnsStub(t, []dnsmessage.SRVResource{
+				// nobody listens there, client should try next one.
+				{Priority: 10, Weight: 1, Port: 1, Target: dnsmessage.MustNewName("localhost.")},
+				{Priority: 20, Weight: 1, Port: 1234, Target: dnsmessage.MustNewName("localhost.")},
+			}),
+		},
+	}
+	testEchoClientAt(t, addr, &socketman.Server{}, "_socketman._tcp.example.com.", client)
+}
+
+func TestStaticResolver(t *testing.T) {
+	client := &socketman.Client{
+		Resolver: socketman.StaticResolver{
+			"socketman": {"127.0.0.1:1", "127.0.0.1:1234"},
+		},
+	}
+	testEchoServerAt(t, addr, &socketman.Server{}, "socketman", client)
+
+	err := client.ConnectFunc("unknown", echoHandler)
+	if err == nil {
+		t.Fatal("connecting to an unresolvable address should fail")
+	}
+}
@@ -0,0 +1,221 @@
+package socketman
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+//DefaultSniffTimeout is the SniffTimeout of a Router
+//when zero.
+const DefaultSniffTimeout = time.Second
+
+//Router is a Handler dispatching connections to the handler
+//of their first matching Route, so one port can serve several
+//protocols. Use it with Server.Serve or ListenAndServe.
+//
+//Matchers can look at the TLS ALPN protocol and server name,
+//or sniff the first bytes of a connection. Sniffed bytes
+//are not consumed: handlers read them.
+type Router struct {
+	Routes []Route
+
+	//Fallback handles connections no route matched.
+	//If nil they are closed.
+	Fallback Handler
+
+	//SniffTimeout bounds how long matchers wait for bytes.
+	//Once passed they only see what was received.
+	//Zero means DefaultSniffTimeout.
+	//
+	//A timed out read breaks a compressed stream (see
+	//Config.Compressors) or a WebSocket connection, whose
+	//reads fail for good once one did: such connections are
+	//closed once SniffTimeout passed instead of being routed.
+	SniffTimeout time.Duration
+}
+
+//Route sends connections Match accepts to Handler.
+type Route struct {
+	Match   Matcher
+	Handler Handler
+}
+
+//Matcher tells whether a connection matches a route.
+type Matcher func(s *Sniffer) bool
+
+//Sniffer gives matchers a look at a connection.
+type Sniffer struct {
+	rw       io.ReadWriter
+	buf      []byte
+	err      error // stops sniffing
+	deadline time.Time
+}
+
+//TLS returns the TLS state of the connection,
+//or nil if it's not a TLS connection.
+func (s *Sniffer) TLS() *tls.ConnectionState {
+	if c, ok := connOf(s.rw); ok {
+		return tlsState(c.netCon)
+	}
+	return nil
+}
+
+//Peek returns the first n bytes of the connection without
+//consuming them. It returns less if the peer didn't send them
+//before the sniff timeout, or closed the connection.
+func (s *Sniffer) Peek(n int) []byte {
+	if len(s.buf) < n && s.err == nil {
+		c, ok := connOf(s.rw)
+		if ok {
+			c.setSniffDeadline(s.deadline)
+			defer c.setSniffDeadline(time.Time{})
+		}
+		chunk := make([]byte, 512)
+		for len(s.buf) < n && s.err == nil {
+			var m int
+			m, s.err = s.rw.Read(chunk)
+			s.buf = append(s.buf, chunk[:m]...)
+		}
+	}
+	if len(s.buf) < n {
+		return s.buf
+	}
+	return s.buf[:n]
+}
+
+//broken tells whether sniffing timed out on a compressed
+//stream or a WebSocket connection, which can't be read any more.
+func (s *Sniffer) broken() bool {
+	c, ok := connOf(s.rw)
+	if !ok || !isTimeout(s.err) {
+		return false
+	}
+	_, ws := c.netCon.(*WebSocketConn)
+	return c.compressed || ws
+}
+
+//ServeSocket runs the handler of the first matching route.
+func (r *Router) ServeSocket(rw io.ReadWriter) {
+	timeout := r.SniffTimeout
+	if timeout == 0 {
+		timeout = DefaultSniffTimeout
+	}
+	s := &Sniffer{rw: rw, deadline: time.Now().Add(timeout)}
+	handler := r.Fallback
+	for _, route := range r.Routes {
+		if route.Match(s) {
+			handler = route.Handler
+			break
+		}
+	}
+	if s.broken() {
+		log.Printf("socketman: sniffing a compressed or WebSocket connection timed out")
+		if c, ok := connOf(rw); ok {
+			c.Close()
+		}
+		return
+	}
+	if len(s.buf) > 0 {
+		rw = unread(rw, s.buf)
+	}
+	if handler == nil {
+		log.Printf("socketman: no route for connection")
+		return
+	}
+	handler.ServeSocket(rw)
+}
+
+//unread makes p the next bytes read from rw.
+func unread(rw io.ReadWriter, p []byte) io.ReadWriter {
+	if c, ok := connOf(rw); ok {
+		c.r = io.MultiReader(bytes.NewReader(p), c.r)
+		return c
+	}
+	return struct {
+		io.Reader
+		io.Writer
+	}{io.MultiReader(bytes.NewReader(p), rw), rw}
+}
+
+//MatchALPN matches TLS connections which negotiated
+//one of protocols. Servers must list them in
+//TLSConfig.NextProtos.
+func MatchALPN(protocols ...string) Matcher {
+	return func(s *Sniffer) bool {
+		state := s.TLS()
+		if state == nil {
+			return false
+		}
+		for _, p := range protocols {
+			if state.NegotiatedProtocol == p {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+//MatchServerName matches TLS connections whose client asked
+//for one of names (SNI). A name like "*.example.com" matches
+//any subdomain of example.com.
+func MatchServerName(names ...string) Matcher {
+	return func(s *Sniffer) bool {
+		state := s.TLS()
+		if state == nil {
+			return false
+		}
+		for _, name := range names {
+			if matchHostname(name, state.ServerName) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+//matchHostname tells whether host matches pattern,
+//which can start with a "*." wildcard.
+func matchHostname(pattern, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		i := strings.IndexByte(host, '.')
+		return i > 0 && host[i:] == pattern[1:]
+	}
+	return pattern == host
+}
+
+//MatchPrefix matches connections starting with one of prefixes.
+func MatchPrefix(prefixes ...[]byte) Matcher {
+	return func(s *Sniffer) bool {
+		for _, p := range prefixes {
+			if bytes.Equal(s.Peek(len(p)), p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+//MatchHTTP matches HTTP/1 requests.
+func MatchHTTP() Matcher {
+	var verbs [][]byte
+	for _, v := range []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"} {
+		verbs = append(verbs, []byte(v+" "))
+	}
+	return MatchPrefix(verbs...)
+}
+
+//MatchTLS matches connections starting with a TLS ClientHello,
+//to route TLS a handler terminates itself.
+func MatchTLS() Matcher {
+	return func(s *Sniffer) bool {
+		// record type handshake, major version 3,
+		// and handshake type client hello.
+		b := s.Peek(6)
+		return len(b) == 6 && b[0] == 0x16 && b[1] == 0x03 && b[5] == 0x01
+	}
+}
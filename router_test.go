@@ -0,0 +1,173 @@
+package socketman_test
+
+import (
+	"crypto/tls"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+	"github.com/azr/socketman/internal"
+)
+
+// named answers name followed by what it reads,
+// up to n bytes.
+func named(name string, n int) socketman.Handler {
+	return socketman.HandlerFunc(func(c io.ReadWriter) {
+		buf := make([]byte, n)
+		m, _ := io.ReadFull(c, buf)
+		io.WriteString(c, name+":"+string(buf[:m]))
+	})
+}
+
+// route connects with client, sends send and
+// returns the whole answer.
+func route(t *testing.T, client *socketman.Client, send string) string {
+	var answer []byte
+	err := client.ConnectFunc(addr, func(c io.ReadWriter) {
+		io.WriteString(c, send)
+		answer, _ = io.ReadAll(c)
+	})
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	return string(answer)
+}
+
+func serve(t *testing.T, server *socketman.Server, handler socketman.Handler) func() {
+	done := make(chan error, 1)
+	go func() { done <- server.ListenAndServe(addr, handler) }()
+	time.Sleep(10 * time.Millisecond)
+	return func() {
+		server.Close()
+		<-done
+	}
+}
+
+func TestRouter_sniff(t *testing.T) {
+	router := &socketman.Router{
+		Routes: []socketman.Route{
+			{Match: socketman.MatchPrefix([]byte("PING")), Handler: named("ping", 4)},
+			{Match: socketman.MatchHTTP(), Handler: named("http", 4)},
+			{Match: socketman.MatchTLS(), Handler: named("tls", 1)},
+		},
+		Fallback:     named("fallback", 2),
+		SniffTimeout: 50 * time.Millisecond,
+	}
+	defer serve(t, &socketman.Server{Config: socketman.Config{CypherPool: aespool}}, router)()
+	client := &socketman.Client{Config: socketman.Config{CypherPool: aespool}}
+
+	tests := map[string]string{
+		"PING":                        "ping:PING",
+		"GET / HTTP/1.1\r\n\r\n":      "http:GET ",
+		"\x16\x03\x01\x00\x05\x01abc": "tls:\x16",
+		"hi there":                    "fallback:hi",
+		// waits for more until SniffTimeout.
+		"PI": "fallback:PI",
+	}
+	for send, expected := range tests {
+		if answer := route(t, client, send); answer != expected {
+			t.Errorf("sending %q: expected %q, got %q", send, expected, answer)
+		}
+	}
+}
+
+func TestRouter_TLS(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := &socketman.Router{
+		Routes: []socketman.Route{
+			{Match: socketman.MatchALPN("proto/b"), Handler: named("b", 0)},
+			{Match: socketman.MatchServerName("*.example.com"), Handler: named("example", 0)},
+		},
+		Fallback: named("fallback", 0),
+	}
+	server := &socketman.Server{Config: socketman.Config{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"proto/a", "proto/b"},
+	}}}
+	defer serve(t, server, router)()
+
+	tests := []struct {
+		protos     []string
+		serverName string
+		expected   string
+	}{
+		{[]string{"proto/b"}, "", "b:"},
+		{[]string{"proto/a"}, "api.example.com", "example:"},
+		{nil, "API.Example.com", "example:"},
+		{[]string{"proto/a"}, "example.com", "fallback:"},
+		{nil, "", "fallback:"},
+	}
+	for _, tt := range tests {
+		client := &socketman.Client{Config: socketman.Config{TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         tt.protos,
+			ServerName:         tt.serverName,
+		}}}
+		if answer := route(t, client, ""); answer != tt.expected {
+			t.Errorf("ALPN %v and SNI %q: expected %q, got %q", tt.protos, tt.serverName, tt.expected, answer)
+		}
+	}
+}
+
+func TestRouter_compressed(t *testing.T) {
+	config := socketman.Config{
+		Compressors: []socketman.Compressor{socketman.DeflateCompressor{}},
+	}
+	router := &socketman.Router{
+		Routes:       []socketman.Route{{Match: socketman.MatchPrefix([]byte("PING")), Handler: named("ping", 4)}},
+		Fallback:     named("fallback", 2),
+		SniffTimeout: 50 * time.Millisecond,
+	}
+	defer serve(t, &socketman.Server{Config: config}, router)()
+	client := &socketman.Client{Config: config}
+
+	if answer := route(t, client, "PING"); answer != "ping:PING" {
+		t.Fatalf("expected ping:PING, got %q", answer)
+	}
+	// the stream broke waiting for more: no handler sees it.
+	if answer := route(t, client, "PI"); answer != "" {
+		t.Fatalf("connection should be closed once sniffing timed out, got %q", answer)
+	}
+}
+
+func TestRouter_webSocket(t *testing.T) {
+	// speaks first, then echoes what the client answers.
+	greeter := socketman.HandlerFunc(func(c io.ReadWriter) {
+		io.WriteString(c, "hello")
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(c, buf); err == nil {
+			c.Write(buf)
+		}
+	})
+	router := &socketman.Router{
+		Routes:       []socketman.Route{{Match: socketman.MatchPrefix([]byte("PING")), Handler: named("ping", 4)}},
+		Fallback:     greeter,
+		SniffTimeout: 50 * time.Millisecond,
+	}
+	server := &socketman.Server{Config: socketman.Config{WebSocket: &socketman.WebSocketConfig{}}}
+	defer serve(t, server, router)()
+	client := &socketman.Client{}
+
+	var answer []byte
+	err := client.ConnectFunc("ws://"+addr+"/", func(c io.ReadWriter) {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		answer = buf
+		io.WriteString(c, "hi")
+		rest, _ := io.ReadAll(c)
+		answer = append(answer, rest...)
+	})
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	// the timed out read failed the websocket for good.
+	if len(answer) != 0 {
+		t.Fatalf("connection should be closed once sniffing timed out, got %q", answer)
+	}
+}
@@ -5,6 +5,7 @@ package socketman
 
 import (
 	"crypto/tls"
+	"errors"
 	"io"
 	"log"
 	"net"
@@ -28,13 +29,60 @@ type Server struct {
 	//it's used as a copy
 	Context context.Context
 
+	//UnixSocket configures socket files of unix:// addresses.
+	UnixSocket UnixSocket
+
+	//Listeners is the number of listeners ListenAndServe opens on
+	//TCP addresses, each accepting in its own goroutine.
+	//Above 1, they are opened with SO_REUSEPORT and the kernel
+	//spreads incoming connections among them; this is Linux only.
+	Listeners int
+
+	//VirtualHosts configures connections by the server name
+	//clients ask for in their TLS handshake (SNI). Keys are
+	//lower case names, or wildcards like "*.example.com"
+	//matching one more label. Other connections use Config,
+	//unless RejectUnknownHosts is set.
+	//
+	//It requires Config.TLSConfig.
+	VirtualHosts map[string]*VirtualHost
+
+	//RejectUnknownHosts makes the TLS handshake of clients asking
+	//for names not in VirtualHosts, or none, fail.
+	//
+	//It requires Config.TLSConfig.
+	RejectUnknownHosts bool
+
+	//TicketKeyRotation, if positive, replaces the key encrypting
+	//TLS session tickets with a random one this often. The previous
+	//keys, up to TicketKeys in all, still decrypt tickets so clients
+	//keep resuming sessions across rotations. The keys are shared
+	//by all listeners of the server, not by configs returned by
+	//GetConfigForClient or of VirtualHosts.
+	TicketKeyRotation time.Duration
+
+	//TicketKeys is the number of session ticket keys kept
+	//with TicketKeyRotation; zero means DefaultTicketKeys.
+	TicketKeys int
+
 	ctx           context.Context // initialised on first ListenAndServe call.
 	cancelContext func()          // initialised on first ListenAndServe call.
 
-	// mu guards ctx and cancelContext
+	listeners map[net.Listener]struct{} // listeners being served
+	conns     map[net.Conn]struct{}     // connections being handled
+	accepting int                       // Accept calls not yet tracked in conns
+	tickets   *ticketKeys               // initialised with TicketKeyRotation.
+
+	// mu guards ctx, cancelContext, listeners, conns, accepting and tickets
 	mu sync.RWMutex
+
+	handshakes tlsCounter
 }
 
+//ErrServerClosed is returned by Serve and ListenAndServe
+//after a call to Close or Shutdown.
+var ErrServerClosed = errors.New("socketman: Server closed")
+
 //ListenAndServe listens on the TCP network address addr and
 //then calls handler to handle requests on incoming connections.
 //
@@ -52,8 +100,91 @@ type Server struct {
 //If host is omitted, as in ":8080", ListenAndServe listens on all available
 //interfaces instead of just the interface with the given host address.
 //See net.Dial for more details about address syntax.
+//See Listeners to accept TCP connections with several listeners.
+//
+//Unix domain sockets are supported with "unix://path", like in
+//"unix:///run/socketman.sock", and "unix://@name" for linux's
+//abstract namespace. See UnixSocket and PeerCredentials.
 func (s *Server) ListenAndServe(addr string, handler Handler) error {
+	if network, address := splitAddr(addr); network == "tcp" && s.Listeners > 1 {
+		return s.listenAndServeReusePort(address, handler)
+	}
+	listener, err := listen(addr, s.Config.TCP, s.UnixSocket)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener, handler)
+}
 
+//listen opens a listener on addr, with tcp options for
+//TCP addresses and unixSocket for unix socket files.
+func listen(addr string, tcp TCPOptions, unixSocket UnixSocket) (net.Listener, error) {
+	network, address := splitAddr(addr)
+	if network == "unix" {
+		return listenUnix(address, unixSocket)
+	}
+	// listen using tcp because we need to make sure order
+	// and integrity is kept. Thanks tcp !
+	lc := net.ListenConfig{
+		Control:   tcp.control,
+		KeepAlive: -1, // set with other options on accept
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+//listenAndServeReusePort serves address with s.Listeners
+//SO_REUSEPORT listeners. The first error of their Serve
+//calls is returned, after the other listeners are closed.
+func (s *Server) listenAndServeReusePort(address string, handler Handler) error {
+	options := s.Config.TCP
+	options.ReusePort = true
+	lc := net.ListenConfig{
+		Control:   options.control,
+		KeepAlive: -1,
+	}
+	listeners := make([]net.Listener, 0, s.Listeners)
+	for i := 0; i < s.Listeners; i++ {
+		l, err := lc.Listen(context.Background(), "tcp", address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+		address = l.Addr().String() // same port when listening on :0
+	}
+
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errc <- s.Serve(l, handler)
+		}(l)
+	}
+	err := <-errc
+	for _, l := range listeners {
+		l.Close()
+	}
+	for range listeners[1:] {
+		<-errc
+	}
+	return err
+}
+
+// Serve accepts incoming connections on the Listener l, creating a
+// new service goroutine for each. The service goroutines read requests and
+// then call handler to reply to them.
+// Serve always returns a non-nil error; after Close or Shutdown
+// it's ErrServerClosed.
+//
+// If Config.TLSConfig is set, TLS is negotiated on each accepted
+// connection. Connections of a TLS listener, like one made by
+// tls.NewListener, are used as they are.
+// Accepted TCP connections are tuned with Config.TCP.
+//
+// Serve can be used with listeners passed by socket activation,
+// see ActivationListeners.
+func (s *Server) Serve(l net.Listener, handler Handler) error {
 	s.mu.Lock()
 	if s.ctx == nil {
 		if s.Context != nil {
@@ -62,40 +193,48 @@ func (s *Server) ListenAndServe(addr string, handler Handler) error {
 			s.ctx, s.cancelContext = context.WithCancel(context.Background())
 		}
 	}
+	done := s.ctx.Done()
+	var tickets *ticketKeys
+	if s.TicketKeyRotation > 0 && s.Config.TLSConfig != nil {
+		tickets = s.ticketKeys()
+	}
 	s.mu.Unlock()
 
-	// listen using tcp because we need to make sure order
-	// and integrity is kept. Thanks tcp !
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+	if tl, ok := l.(*net.TCPListener); ok {
+		l = tcpListener{tl, &s.Config.TCP}
 	}
-
+	var tlsConfig *tls.Config
 	if s.Config.TLSConfig != nil {
-		config := cloneTLSConfig(s.Config.TLSConfig)
-		tlsListener := tls.NewListener(tcpKeepAliveListener{listener.(*net.TCPListener)}, config)
-		return s.Serve(tlsListener, handler)
+		tlsConfig = s.Config.TLSConfig.Clone()
+		if len(s.VirtualHosts) > 0 || s.RejectUnknownHosts {
+			tlsConfig.GetConfigForClient = s.getConfigForClient
+		}
+		if tickets != nil {
+			tickets.track(tlsConfig, true)
+			defer tickets.track(tlsConfig, false)
+		}
+	} else if len(s.VirtualHosts) > 0 || s.RejectUnknownHosts {
+		l.Close()
+		return errors.New("socketman: VirtualHosts and RejectUnknownHosts require a TLSConfig")
 	}
-	return s.Serve(tcpKeepAliveListener{listener.(*net.TCPListener)}, handler)
-}
 
-// Serve accepts incoming connections on the Listener l, creating a
-// new service goroutine for each. The service goroutines read requests and
-// then call handler to reply to them.
-// Serve always returns a non-nil error.
-func (s *Server) Serve(l net.Listener, handler Handler) error {
+	s.trackListener(l, true)
+	defer s.trackListener(l, false)
 	go func() {
-		s.mu.RLock()
-		done := s.ctx.Done()
-		s.mu.RUnlock()
 		<-done
-
 		l.Close()
 	}()
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
+		s.trackAccept(1)
 		c, e := l.Accept()
 		if e != nil {
+			s.trackAccept(-1)
+			select {
+			case <-done:
+				return ErrServerClosed
+			default:
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -119,25 +258,122 @@ func (s *Server) Serve(l net.Listener, handler Handler) error {
 				log.Printf("socketman: failed to set idle timeout: %s.", e)
 			}
 		}
-		go func() {
-			defer func() {
-				if err := recover(); err != nil {
-					const size = 64 << 10
-					buf := make([]byte, size)
-					buf = buf[:runtime.Stack(buf, false)]
-					log.Printf("socketman: panic serving %v: %v\n%s", l.Addr(), err, buf)
-				}
-			}()
-			conn := newconn(c, s.Config)
-			handler.ServeSocket(conn)
-			err := conn.Close()
-			if err != nil {
-				log.Printf("socketman: connection close failed: %s", err)
+		s.trackConn(c, true)
+		s.trackAccept(-1)
+		go s.serveConn(l, c, tlsConfig, handler)
+	}
+}
+
+//serveConn runs handler on c, accepted on l.
+func (s *Server) serveConn(l net.Listener, c net.Conn, tlsConfig *tls.Config, handler Handler) {
+	defer s.trackConn(c, false)
+	defer func() {
+		if err := recover(); err != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("socketman: panic serving %v: %v\n%s", l.Addr(), err, buf)
+			c.Close()
+		}
+	}()
+	if deadline, ok := s.Config.setupDeadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	config := &s.Config
+	if tlsConfig != nil {
+		tc, ok := c.(*tls.Conn)
+		if !ok {
+			tc = tls.Server(c, tlsConfig)
+		}
+		if err := tc.Handshake(); err != nil {
+			log.Printf("socketman: TLS handshake from %s failed: %s", c.RemoteAddr(), s.Config.handshakeTimeout(err))
+			c.Close()
+			return
+		}
+		c = tc
+		s.handshakes.count(tc.ConnectionState())
+		if vh := s.virtualHost(tc.ConnectionState().ServerName); vh != nil {
+			config = &vh.Config
+			if config.Authorize == nil && s.Config.Authorize != nil {
+				// the server's policy still applies
+				vc := *config
+				vc.Authorize = s.Config.Authorize
+				config = &vc
 			}
-		}()
+			if vh.Handler != nil {
+				handler = vh.Handler
+			}
+			if deadline, ok := config.setupDeadline(); ok {
+				c.SetDeadline(deadline)
+			}
+		}
+	}
+	if err := config.authorize(tlsState(c)); err != nil {
+		log.Printf("socketman: connection from %s refused: %s", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	if config.WebSocket != nil {
+		ws, err := config.WebSocket.serverHandshake(c)
+		if err != nil {
+			log.Printf("socketman: websocket handshake from %s failed: %s", c.RemoteAddr(), config.handshakeTimeout(err))
+			c.Close()
+			return
+		}
+		c = ws
+	}
+	comp, err := config.negotiate(c, false)
+	if err != nil {
+		log.Printf("socketman: negotiation with %s failed: %s", c.RemoteAddr(), config.handshakeTimeout(err))
+		c.Close()
+		return
+	}
+	conn := newconn(c, *config)
+	if err := conn.compress(comp); err != nil {
+		log.Printf("socketman: compression with %s failed: %s", c.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	handler.ServeSocket(conn)
+	if err := conn.Close(); err != nil {
+		log.Printf("socketman: connection close failed: %s", err)
 	}
 }
 
+func (s *Server) trackListener(l net.Listener, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = map[net.Listener]struct{}{}
+	}
+	if add {
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
+
+//trackAccept counts Accept calls, so Shutdown waits for
+//connections accepted but not tracked yet.
+func (s *Server) trackAccept(delta int) {
+	s.mu.Lock()
+	s.accepting += delta
+	s.mu.Unlock()
+}
+
 //ListenAndServeFunc callsListenAndServe with a plain func
 func (s *Server) ListenAndServeFunc(addr string, handler func(io.ReadWriter)) error {
 	return s.ListenAndServe(addr, HandlerFunc(handler))
@@ -155,4 +391,37 @@ func (s *Server) Close() {
 	}
 	s.cancelContext = nil
 	s.ctx = nil
+	s.tickets = nil // rotated until ctx was done
+	for l := range s.listeners {
+		l.Close()
+	}
+}
+
+// shutdownPollInterval is how often Shutdown checks
+// for remaining connections.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown gracefully shuts down the server: it closes the server
+// like Close does and then waits for ongoing connections to be done.
+//
+// If ctx expires before, Shutdown returns the context's error.
+// Remaining connections keep running.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.RLock()
+		active := len(s.conns) + s.accepting
+		s.mu.RUnlock()
+		if active == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
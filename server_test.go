@@ -2,7 +2,10 @@ package socketman_test
 
 import (
 	"crypto/tls"
+	"fmt"
 	"io"
+	"net"
+	"runtime"
 	"testing"
 	"time"
 
@@ -22,8 +25,8 @@ func TestListenAndServePanic(t *testing.T) {
 	s := socketman.Server{}
 
 	go func() {
-		if err := s.ListenAndServeFunc(addr, panicHandler); err != nil {
-			t.Fatalf("could not start server: %s. tests already running ?", err)
+		if err := s.ListenAndServeFunc(addr, panicHandler); err != nil && err != socketman.ErrServerClosed {
+			t.Errorf("could not start server: %s. tests already running ?", err)
 		}
 	}()
 	defer s.Close()
@@ -122,3 +125,101 @@ func TestListenAndServe_with_tls(t *testing.T) {
 
 	testEchoServer(t, server, client)
 }
+
+func TestListenAndServe_listeners(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on linux")
+	}
+	server := &socketman.Server{Listeners: 4}
+	testEchoServer(t, server, &socketman.Client{})
+	testEchoClient(t, server, &socketman.Client{})
+
+	// many connections, spread among listeners
+	served := make(chan struct{}, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServeFunc(addr, func(c io.ReadWriter) {
+			served <- struct{}{}
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < cap(served); i++ {
+		if err := (&socketman.Client{}).ConnectFunc(addr, func(io.ReadWriter) {}); err != nil {
+			t.Fatalf("connect failed: %s", err)
+		}
+	}
+	for i := 0; i < cap(served); i++ {
+		<-served
+	}
+	server.Close()
+	if err := <-done; err != socketman.ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+// BenchmarkAccept measures how fast connections are accepted
+// and handled by servers with one or several listeners.
+func BenchmarkAccept(b *testing.B) {
+	counts := []int{1}
+	if runtime.GOOS == "linux" {
+		counts = append(counts, 4)
+		if n := runtime.GOMAXPROCS(0); n > 4 {
+			counts = append(counts, n)
+		}
+	}
+	for _, n := range counts {
+		b.Run(fmt.Sprintf("listeners=%d", n), func(b *testing.B) {
+			server := &socketman.Server{Listeners: n}
+			done := make(chan error, 1)
+			go func() {
+				done <- server.ListenAndServeFunc(addr, func(c io.ReadWriter) {
+					c.Write([]byte{1})
+				})
+			}()
+			time.Sleep(10 * time.Millisecond)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				buf := make([]byte, 1)
+				for pb.Next() {
+					c, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err := c.Read(buf); err != nil {
+						b.Error(err)
+					}
+					c.Close()
+				}
+			})
+			b.StopTimer()
+			server.Close()
+			<-done
+		})
+	}
+}
+
+func TestServe_tlsListener(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &socketman.Server{Config: socketman.Config{TLSConfig: config}}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(tls.NewListener(l, config), named("ok", 0)) }()
+	defer func() {
+		server.Close()
+		<-done
+	}()
+
+	// TLS is not negotiated twice.
+	if !connects(vhostClient("", nil)) {
+		t.Fatal("connections of a TLS listener should be served")
+	}
+}
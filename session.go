@@ -0,0 +1,155 @@
+package socketman
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"log"
+	"sync"
+	"time"
+)
+
+//DefaultSessionCacheSize is the number of TLS sessions
+//a Client keeps to resume, when TLSConfig has no
+//ClientSessionCache.
+const DefaultSessionCacheSize = 64
+
+//DefaultTicketKeys is the number of session ticket keys
+//a Server keeps when TicketKeys is zero.
+const DefaultTicketKeys = 3
+
+//TLSStats counts TLS handshakes of a Server or Client.
+type TLSStats struct {
+	//Handshakes is the number of successful handshakes.
+	Handshakes uint64
+	//Resumed is how many of them resumed a previous session,
+	//saving a full handshake.
+	Resumed uint64
+}
+
+//ResumptionRate returns the share of handshakes that
+//resumed a session, from 0 to 1.
+func (s TLSStats) ResumptionRate() float64 {
+	if s.Handshakes == 0 {
+		return 0
+	}
+	return float64(s.Resumed) / float64(s.Handshakes)
+}
+
+//tlsCounter counts handshakes for TLSStats.
+type tlsCounter struct {
+	mu    sync.Mutex
+	stats TLSStats
+}
+
+func (t *tlsCounter) count(state tls.ConnectionState) {
+	t.mu.Lock()
+	t.stats.Handshakes++
+	if state.DidResume {
+		t.stats.Resumed++
+	}
+	t.mu.Unlock()
+}
+
+func (t *tlsCounter) get() TLSStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+//TLSStats returns counts of the TLS handshakes of s.
+func (s *Server) TLSStats() TLSStats {
+	return s.handshakes.get()
+}
+
+//TLSStats returns counts of the TLS handshakes of c.
+func (c *Client) TLSStats() TLSStats {
+	return c.handshakes.get()
+}
+
+//sessionCache returns the cache of TLS sessions of c.
+func (c *Client) sessionCache() tls.ClientSessionCache {
+	c.sessionsOnce.Do(func() {
+		c.sessions = tls.NewLRUClientSessionCache(DefaultSessionCacheSize)
+	})
+	return c.sessions
+}
+
+//ticketKeys rotates the session ticket keys of
+//the TLS configs a Server serves with.
+type ticketKeys struct {
+	mu      sync.Mutex
+	keys    [][32]byte // newest first
+	size    int
+	configs map[*tls.Config]struct{}
+}
+
+func newTicketKeys(size int) *ticketKeys {
+	if size <= 0 {
+		size = DefaultTicketKeys
+	}
+	k := &ticketKeys{size: size, configs: map[*tls.Config]struct{}{}}
+	if err := k.rotate(); err != nil {
+		// tls generates its own keys meanwhile
+		log.Printf("socketman: session ticket key rotation failed: %s", err)
+	}
+	return k
+}
+
+//rotate makes a new key encrypt tickets; previous
+//keys still decrypt them, up to size keys.
+func (k *ticketKeys) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = append([][32]byte{key}, k.keys...)
+	if len(k.keys) > k.size {
+		k.keys = k.keys[:k.size]
+	}
+	for config := range k.configs {
+		config.SetSessionTicketKeys(k.keys)
+	}
+	return nil
+}
+
+//track starts or stops rotating the keys of config.
+func (k *ticketKeys) track(config *tls.Config, add bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !add {
+		delete(k.configs, config)
+		return
+	}
+	k.configs[config] = struct{}{}
+	if len(k.keys) > 0 {
+		config.SetSessionTicketKeys(k.keys)
+	}
+}
+
+//run rotates keys every interval until done is closed.
+func (k *ticketKeys) run(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		if err := k.rotate(); err != nil {
+			log.Printf("socketman: session ticket key rotation failed: %s", err)
+		}
+	}
+}
+
+//ticketKeys returns the session ticket keys of s, starting
+//their rotation on first call. Called with s.mu held.
+func (s *Server) ticketKeys() *ticketKeys {
+	if s.tickets == nil {
+		s.tickets = newTicketKeys(s.TicketKeys)
+		go s.tickets.run(s.TicketKeyRotation, s.ctx.Done())
+	}
+	return s.tickets
+}
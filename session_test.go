@@ -0,0 +1,103 @@
+package socketman_test
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+)
+
+func TestSessionResumption(t *testing.T) {
+	cert := selfSigned(t, "server.example.org")
+	server := &socketman.Server{Config: socketman.Config{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}}}
+	defer serve(t, server, named("ok", 0))()
+
+	client := vhostClient("server.example.org", &cert)
+	for i := 0; i < 3; i++ {
+		if !connects(client) {
+			t.Fatal("connect failed")
+		}
+	}
+	expected := socketman.TLSStats{Handshakes: 3, Resumed: 2}
+	if stats := client.TLSStats(); stats != expected {
+		t.Fatalf("client: expected %+v, got %+v", expected, stats)
+	}
+	if stats := server.TLSStats(); stats != expected {
+		t.Fatalf("server: expected %+v, got %+v", expected, stats)
+	}
+	if rate := expected.ResumptionRate(); rate < 0.66 || rate > 0.67 {
+		t.Fatalf("unexpected resumption rate %f", rate)
+	}
+
+	disabled := vhostClient("server.example.org", &cert)
+	disabled.Config.TLSConfig.SessionTicketsDisabled = true
+	connects(disabled)
+	connects(disabled)
+	if stats := disabled.TLSStats(); stats.Resumed != 0 || stats.Handshakes != 2 {
+		t.Fatalf("sessions should not be resumed without tickets, got %+v", stats)
+	}
+}
+
+func TestTicketKeyRotation(t *testing.T) {
+	cert := selfSigned(t, "server.example.org")
+	server := &socketman.Server{
+		Config: socketman.Config{TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}},
+		TicketKeyRotation: 100 * time.Millisecond,
+		TicketKeys:        3,
+	}
+	defer serve(t, server, named("ok", 0))()
+
+	client := vhostClient("server.example.org", &cert)
+	resumed := func() bool {
+		before := client.TLSStats().Resumed
+		if !connects(client) {
+			t.Fatal("connect failed")
+		}
+		return client.TLSStats().Resumed > before
+	}
+	resumed()
+	if !resumed() {
+		t.Fatal("session should be resumed with a recent key")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !resumed() {
+		t.Fatal("session should be resumed with a previous key")
+	}
+	time.Sleep(500 * time.Millisecond)
+	if resumed() {
+		t.Fatal("session should not be resumed once its key is dropped")
+	}
+	if stats := server.TLSStats(); stats.Handshakes != 4 || stats.Resumed != 2 {
+		t.Fatalf("unexpected server stats %+v", stats)
+	}
+}
+
+func TestTicketKeyRotation_restart(t *testing.T) {
+	cert := selfSigned(t, "server.example.org")
+	server := &socketman.Server{
+		Config: socketman.Config{TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}},
+		TicketKeyRotation: 50 * time.Millisecond,
+		TicketKeys:        1,
+	}
+	serve(t, server, named("ok", 0))()
+	defer serve(t, server, named("ok", 0))()
+
+	client := vhostClient("server.example.org", &cert)
+	if !connects(client) {
+		t.Fatal("connect failed")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !connects(client) {
+		t.Fatal("connect failed")
+	}
+	if stats := client.TLSStats(); stats.Resumed != 0 {
+		t.Fatalf("keys should keep rotating after a restart, got %+v", stats)
+	}
+}
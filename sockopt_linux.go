@@ -0,0 +1,20 @@
+package socketman
+
+import (
+	"syscall"
+	"time"
+)
+
+//Not defined by package syscall.
+const (
+	soReusePort    = 0xf
+	tcpUserTimeout = 0x12
+)
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
+
+func setUserTimeout(fd uintptr, d time.Duration) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(d/time.Millisecond))
+}
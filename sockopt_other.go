@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package socketman
+
+import (
+	"errors"
+	"time"
+)
+
+func setReusePort(fd uintptr) error {
+	return errors.New("socketman: SO_REUSEPORT is not supported on this platform")
+}
+
+func setUserTimeout(fd uintptr, d time.Duration) error {
+	return errors.New("socketman: TCP_USER_TIMEOUT is not supported on this platform")
+}
@@ -0,0 +1,172 @@
+package socketman
+
+import (
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+//defaultKeepAlive is the keep-alive idle time of TCP connections.
+const defaultKeepAlive = 3 * time.Minute
+
+//TCPOptions tunes TCP sockets of a Server, on accept, and of a
+//Client, on dial.
+//The zero value keeps system defaults, with keep-alive enabled.
+type TCPOptions struct {
+	//KeepAlive is how long a connection must be idle before
+	//keep-alive probes are sent. Zero means 3 minutes;
+	//negative disables keep-alive.
+	KeepAlive time.Duration
+
+	//KeepAliveInterval is the time between keep-alive probes,
+	//KeepAlive if zero.
+	KeepAliveInterval time.Duration
+
+	//KeepAliveCount is the number of unanswered probes after which
+	//the connection is dropped. Zero keeps the system default.
+	KeepAliveCount int
+
+	//Nagle enables Nagle's algorithm, unsetting TCP_NODELAY.
+	Nagle bool
+
+	//ReadBuffer and WriteBuffer set SO_RCVBUF and SO_SNDBUF.
+	//Zero keeps system defaults.
+	ReadBuffer  int
+	WriteBuffer int
+
+	//Linger sets SO_LINGER: Close blocks until unsent data is sent
+	//or Linger elapsed. Negative discards unsent data and resets the
+	//connection on Close. Zero keeps the default: data is sent in
+	//the background.
+	Linger time.Duration
+
+	//UserTimeout sets TCP_USER_TIMEOUT: how long sent data can stay
+	//unacknowledged before the connection is dropped. Linux only.
+	UserTimeout time.Duration
+
+	//ReusePort sets SO_REUSEPORT on listening sockets, so several
+	//of them can listen on the same address. Linux only.
+	ReusePort bool
+
+	//Control, if set, is called with the raw socket of listeners
+	//and dialed connections before they bind or connect, and with
+	//accepted connections. It can set any socket option.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+func (o *TCPOptions) keepAliveConfig() net.KeepAliveConfig {
+	if o.KeepAlive < 0 {
+		return net.KeepAliveConfig{Enable: false, Idle: -1, Interval: -1, Count: -1}
+	}
+	c := net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     o.KeepAlive,
+		Interval: o.KeepAliveInterval,
+		Count:    o.KeepAliveCount,
+	}
+	if c.Idle == 0 {
+		c.Idle = defaultKeepAlive
+	}
+	if c.Interval == 0 {
+		c.Interval = c.Idle
+	}
+	if c.Count == 0 {
+		c.Count = -1
+	}
+	return c
+}
+
+//control is used as net.ListenConfig and net.Dialer Control.
+func (o *TCPOptions) control(network, address string, c syscall.RawConn) error {
+	if o.ReusePort {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = setReusePort(fd)
+		}); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if o.Control != nil {
+		return o.Control(network, address, c)
+	}
+	return nil
+}
+
+//apply sets options of a connected socket. Control is
+//called for accepted ones; dialed ones went through control.
+func (o *TCPOptions) apply(c *net.TCPConn, accepted bool) error {
+	if err := c.SetKeepAliveConfig(o.keepAliveConfig()); err != nil {
+		return err
+	}
+	if o.Nagle {
+		if err := c.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := c.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := c.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	if o.Linger != 0 {
+		sec := 0
+		if o.Linger > 0 {
+			sec = int((o.Linger + time.Second - 1) / time.Second)
+		}
+		if err := c.SetLinger(sec); err != nil {
+			return err
+		}
+	}
+	if o.UserTimeout <= 0 && (!accepted || o.Control == nil) {
+		return nil
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if o.UserTimeout > 0 {
+		var err error
+		if cerr := raw.Control(func(fd uintptr) {
+			err = setUserTimeout(fd, o.UserTimeout)
+		}); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if accepted && o.Control != nil {
+		return o.Control("tcp", c.RemoteAddr().String(), raw)
+	}
+	return nil
+}
+
+//tcpListener sets TCP options on accepted connections.
+type tcpListener struct {
+	*net.TCPListener
+	options *TCPOptions
+}
+
+func (ln tcpListener) Accept() (net.Conn, error) {
+	for {
+		tc, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		if err := ln.options.apply(tc, true); err != nil {
+			log.Printf("socketman: setting TCP options of %s failed: %s", tc.RemoteAddr(), err)
+			tc.Close()
+			continue
+		}
+		return tc, nil
+	}
+}
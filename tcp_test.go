@@ -0,0 +1,150 @@
+package socketman_test
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+)
+
+func TestTCPOptions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("socket options are checked with linux constants")
+	}
+	const (
+		tcpKeepIdle    = 0x4
+		tcpKeepIntvl   = 0x5
+		tcpKeepCnt     = 0x6
+		tcpUserTimeout = 0x12
+	)
+	opts := socketman.TCPOptions{
+		KeepAlive:         time.Minute,
+		KeepAliveInterval: 10 * time.Second,
+		KeepAliveCount:    4,
+		Nagle:             true,
+		ReadBuffer:        32 << 10,
+		Linger:            5 * time.Second,
+		UserTimeout:       20 * time.Second,
+	}
+
+	type check struct {
+		desc         string
+		level, name  int
+		expected     int
+		atLeastValue bool // the kernel may round buffer sizes up
+	}
+	checks := []check{
+		{"SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1, false},
+		{"TCP_KEEPIDLE", syscall.IPPROTO_TCP, tcpKeepIdle, 60, false},
+		{"TCP_KEEPINTVL", syscall.IPPROTO_TCP, tcpKeepIntvl, 10, false},
+		{"TCP_KEEPCNT", syscall.IPPROTO_TCP, tcpKeepCnt, 4, false},
+		{"TCP_NODELAY", syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 0, false},
+		{"SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, 32 << 10, true},
+		{"TCP_USER_TIMEOUT", syscall.IPPROTO_TCP, tcpUserTimeout, 20000, false},
+	}
+
+	accepted := make(chan error, 1)
+	server := &socketman.Server{Config: socketman.Config{TCP: opts}}
+	server.Config.TCP.Control = func(network, address string, c syscall.RawConn) error {
+		if !strings.HasPrefix(network, "tcp") || address == "" {
+			t.Errorf("unexpected control call on %s %q", network, address)
+		}
+		var err error
+		c.Control(func(fd uintptr) {
+			if address == addr {
+				return // the listener
+			}
+			for _, ch := range checks {
+				v, gerr := syscall.GetsockoptInt(int(fd), ch.level, ch.name)
+				if gerr != nil || v < ch.expected || (!ch.atLeastValue && v != ch.expected) {
+					err = errors.Join(err, errors.New(ch.desc+" not set"))
+				}
+			}
+			// reads the l_onoff field of struct linger
+			onoff, lerr := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_LINGER)
+			if lerr != nil || onoff != 1 {
+				err = errors.Join(err, errors.New("SO_LINGER not set"))
+			}
+		})
+		if address != addr {
+			accepted <- err
+		}
+		return nil
+	}
+
+	dialed := false
+	client := &socketman.Client{Config: socketman.Config{TCP: opts}}
+	client.Config.TCP.Control = func(network, address string, c syscall.RawConn) error {
+		dialed = address == addr
+		return nil
+	}
+	testEchoServer(t, server, client)
+	if err := <-accepted; err != nil {
+		t.Fatalf("accepted connection: %s", err)
+	}
+	if !dialed {
+		t.Fatal("Control should be called when dialing")
+	}
+}
+
+func TestTCPOptions_linger(t *testing.T) {
+	// a negative Linger resets the connection on close
+	closed := make(chan error, 1)
+	test(t, &socketman.Server{}, func(c io.ReadWriter) {
+		_, err := c.Read(make([]byte, 1))
+		closed <- err
+	}, &socketman.Client{Config: socketman.Config{TCP: socketman.TCPOptions{Linger: -1}}}, func(c io.ReadWriter) {})
+	if err := <-closed; !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("expected a connection reset, got %v", err)
+	}
+}
+
+func TestTCPOptions_control(t *testing.T) {
+	refuse := errors.New("refused by control")
+	client := &socketman.Client{Config: socketman.Config{TCP: socketman.TCPOptions{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return refuse
+		},
+	}}}
+	if err := client.ConnectFunc(addr, echoHandler); !errors.Is(err, refuse) {
+		t.Fatalf("expected the Control error, got %v", err)
+	}
+}
+
+func TestTCPOptions_reusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on linux")
+	}
+	listen := func(s *socketman.Server) chan error {
+		errc := make(chan error, 1)
+		go func() { errc <- s.ListenAndServeFunc(addr, echoHandler) }()
+		return errc
+	}
+	opts := socketman.Config{TCP: socketman.TCPOptions{ReusePort: true}}
+	s1, s2 := &socketman.Server{Config: opts}, &socketman.Server{Config: opts}
+	errc1 := listen(s1)
+	errc2 := listen(s2)
+	time.Sleep(10 * time.Millisecond)
+	s1.Close()
+	s2.Close()
+	for _, errc := range []chan error{errc1, errc2} {
+		if err := <-errc; err != socketman.ErrServerClosed {
+			t.Fatalf("both servers should listen with SO_REUSEPORT, got %v", err)
+		}
+	}
+
+	s3, s4 := &socketman.Server{}, &socketman.Server{}
+	errc3 := listen(s3)
+	time.Sleep(10 * time.Millisecond)
+	errc4 := listen(s4)
+	if err := <-errc4; err == nil || err == socketman.ErrServerClosed {
+		t.Fatalf("listening twice without SO_REUSEPORT should fail, got %v", err)
+	}
+	s3.Close()
+	<-errc3
+}
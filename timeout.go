@@ -0,0 +1,77 @@
+package socketman
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+//TimeoutError is returned when a connection exceeds
+//one of the timeouts of its Config.
+//It's a net.Error whose Timeout method returns true.
+type TimeoutError struct {
+	//Limit is the Config field that fired: "IdleTimeout",
+	//"ReadTimeout", "WriteTimeout", "HandshakeTimeout" or
+	//"MaxConnectionAge".
+	Limit string
+
+	//Duration is the value of that field.
+	Duration time.Duration
+
+	//Err is the error of the operation that failed.
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("socketman: %s of %s exceeded", e.Limit, e.Duration)
+}
+
+func (e *TimeoutError) Unwrap() error { return e.Err }
+
+//Timeout returns true.
+func (e *TimeoutError) Timeout() bool { return true }
+
+//Temporary returns true, like other timeouts.
+func (e *TimeoutError) Temporary() bool { return true }
+
+var _ net.Error = &TimeoutError{}
+
+//isTimeout tells whether err is a deadline being exceeded.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+//handshakeTimeout wraps err if it's a timeout of a
+//handshake bounded by c.HandshakeTimeout.
+func (c *Config) handshakeTimeout(err error) error {
+	if c.HandshakeTimeout > 0 && isTimeout(err) {
+		return &TimeoutError{Limit: "HandshakeTimeout", Duration: c.HandshakeTimeout, Err: err}
+	}
+	return err
+}
+
+//setupDeadline returns the deadline of a server connection
+//until newconn: HandshakeTimeout, or else IdleTimeout, from now.
+//ok is false if c sets neither.
+func (c *Config) setupDeadline() (deadline time.Time, ok bool) {
+	switch {
+	case c.HandshakeTimeout > 0:
+		return time.Now().Add(c.HandshakeTimeout), true
+	case c.IdleTimeout != 0:
+		return time.Now().Add(c.IdleTimeout), true
+	}
+	return time.Time{}, false
+}
+
+//earliest returns the earliest non zero time of ts.
+func earliest(ts ...time.Time) time.Time {
+	var min time.Time
+	for _, t := range ts {
+		if !t.IsZero() && (min.IsZero() || t.Before(min)) {
+			min = t
+		}
+	}
+	return min
+}
@@ -0,0 +1,269 @@
+package socketman_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+	"github.com/azr/socketman/internal"
+)
+
+func TestTimeouts_read(t *testing.T) {
+	const short = 50 * time.Millisecond
+	tests := map[string]socketman.Config{
+		"ReadTimeout":      {ReadTimeout: short, IdleTimeout: time.Minute, MaxConnectionAge: time.Minute},
+		"IdleTimeout":      {IdleTimeout: short, ReadTimeout: time.Minute, MaxConnectionAge: time.Minute},
+		"MaxConnectionAge": {MaxConnectionAge: short, MaxConnectionAgeJitter: short, ReadTimeout: time.Minute},
+	}
+	for limit, config := range tests {
+		t.Run(limit, func(t *testing.T) {
+			var err error
+			test(t, &socketman.Server{}, func(c io.ReadWriter) {
+				// silent until the client gave up.
+				c.Read(make([]byte, 1))
+			}, &socketman.Client{Config: config}, func(c io.ReadWriter) {
+				_, err = c.Read(make([]byte, 1))
+			})
+			var te *socketman.TimeoutError
+			if !errors.As(err, &te) {
+				t.Fatalf("expected a *TimeoutError, got %v", err)
+			}
+			if te.Limit != limit {
+				t.Fatalf("expected %s to fire, got %s", limit, te.Limit)
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				t.Fatalf("%v should be a net.Error timeout", err)
+			}
+		})
+	}
+}
+
+func TestTimeouts_idleAfterActivity(t *testing.T) {
+	const idle = 50 * time.Millisecond
+	var (
+		err   error
+		quiet time.Duration
+	)
+	test(t, &socketman.Server{}, func(c io.ReadWriter) {
+		io.Copy(io.Discard, c)
+	}, &socketman.Client{Config: socketman.Config{IdleTimeout: idle}}, func(c io.ReadWriter) {
+		// activity outlives a few IdleTimeouts.
+		for i := 0; i < 10; i++ {
+			if _, err := c.Write([]byte("ping")); err != nil {
+				t.Errorf("active connection timed out: %s", err)
+				return
+			}
+			time.Sleep(idle / 3)
+		}
+		start := time.Now()
+		_, err = c.Read(make([]byte, 1))
+		quiet = time.Since(start)
+	})
+	var te *socketman.TimeoutError
+	if !errors.As(err, &te) || te.Limit != "IdleTimeout" {
+		t.Fatalf("expected IdleTimeout to fire, got %v", err)
+	}
+	if quiet > idle {
+		t.Fatalf("idle connection should time out %s after its last I/O, took %s more", idle, quiet)
+	}
+}
+
+func TestTimeouts_readIndependentOfWrites(t *testing.T) {
+	// writing doesn't postpone ReadTimeout, unlike IdleTimeout.
+	var err error
+	test(t, &socketman.Server{}, func(c io.ReadWriter) {
+		io.Copy(io.Discard, c)
+	}, &socketman.Client{Config: socketman.Config{ReadTimeout: 100 * time.Millisecond}}, func(c io.ReadWriter) {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(10 * time.Millisecond):
+					c.Write([]byte("ping"))
+				}
+			}
+		}()
+		_, err = c.Read(make([]byte, 1))
+	})
+	var te *socketman.TimeoutError
+	if !errors.As(err, &te) || te.Limit != "ReadTimeout" {
+		t.Fatalf("expected ReadTimeout to fire, got %v", err)
+	}
+}
+
+func TestTimeouts_write(t *testing.T) {
+	var err error
+	release := make(chan struct{})
+	test(t, &socketman.Server{}, func(c io.ReadWriter) {
+		// doesn't read, so the client's writes block.
+		<-release
+	}, &socketman.Client{Config: socketman.Config{WriteTimeout: 50 * time.Millisecond, ReadTimeout: time.Minute}}, func(c io.ReadWriter) {
+		defer close(release)
+		buf := make([]byte, 64<<10)
+		for err == nil {
+			_, err = c.Write(buf)
+		}
+	})
+	var te *socketman.TimeoutError
+	if !errors.As(err, &te) || te.Limit != "WriteTimeout" {
+		t.Fatalf("expected WriteTimeout to fire, got %v", err)
+	}
+}
+
+func TestTimeouts_activeConnection(t *testing.T) {
+	// per operation timeouts don't fire on a busy connection.
+	config := socketman.Config{ReadTimeout: 50 * time.Millisecond, WriteTimeout: 50 * time.Millisecond}
+	server := &socketman.Server{Config: config}
+	client := &socketman.Client{Config: config}
+	test(t, server, echoHandler, client, func(c io.ReadWriter) {
+		out := make([]byte, 5)
+		for deadline := time.Now().Add(200 * time.Millisecond); time.Now().Before(deadline); {
+			if _, err := io.WriteString(c, "hello"); err != nil {
+				t.Errorf("write failed: %s", err)
+				return
+			}
+			if _, err := io.ReadFull(c, out); err != nil {
+				t.Errorf("read failed: %s", err)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestTimeouts_clientHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// accepts but never answers the websocket handshake.
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(io.Discard, c)
+	}()
+
+	client := &socketman.Client{Config: socketman.Config{HandshakeTimeout: 50 * time.Millisecond}}
+	err = client.ConnectFunc("ws://"+addr+"/", echoHandler)
+	var te *socketman.TimeoutError
+	if !errors.As(err, &te) || te.Limit != "HandshakeTimeout" {
+		t.Fatalf("expected HandshakeTimeout to fire, got %v", err)
+	}
+}
+
+func TestTimeouts_serverHandshake(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &socketman.Server{Config: socketman.Config{
+		TLSConfig:        &tls.Config{Certificates: []tls.Certificate{cert}},
+		HandshakeTimeout: 50 * time.Millisecond,
+	}}
+	errc := make(chan error, 1)
+	go func() { errc <- server.ListenAndServeFunc(addr, echoHandler) }()
+	defer func() {
+		server.Close()
+		<-errc
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// never sends a ClientHello.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("server should hang up once HandshakeTimeout passed")
+	}
+}
+
+// writes writes small chunks to w b.N times,
+// where deadline upkeep shows the most.
+func writes(b *testing.B, w io.Writer) {
+	buf := make([]byte, 16)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(buf); err != nil {
+			b.Error(err)
+			return
+		}
+	}
+	b.StopTimer()
+}
+
+// deadlineWriter sets a deadline before each write,
+// like IdleTimeout used to.
+type deadlineWriter struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(b []byte) (int, error) {
+	w.SetDeadline(time.Now().Add(w.timeout))
+	return w.Conn.Write(b)
+}
+
+// BenchmarkIdleTimeout compares the upkeep of IdleTimeout, the
+// difference between IdleTimeout=1m and IdleTimeout=0, with
+// the one of a deadline per operation: SetDeadline against raw.
+func BenchmarkIdleTimeout(b *testing.B) {
+	server := &socketman.Server{}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServeFunc(addr, func(c io.ReadWriter) {
+			io.Copy(io.Discard, c)
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer func() {
+		server.Close()
+		<-done
+	}()
+
+	for _, idle := range []time.Duration{0, time.Minute} {
+		b.Run(fmt.Sprintf("IdleTimeout=%s", idle), func(b *testing.B) {
+			client := &socketman.Client{Config: socketman.Config{IdleTimeout: idle}}
+			err := client.ConnectFunc(addr, func(c io.ReadWriter) {
+				writes(b, c)
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+	for _, deadline := range []bool{false, true} {
+		name := "raw"
+		if deadline {
+			name = "SetDeadline"
+		}
+		b.Run(name, func(b *testing.B) {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			var w io.Writer = c
+			if deadline {
+				w = deadlineWriter{c, time.Minute}
+			}
+			writes(b, w)
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package socketman_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/azr/socketman"
+)
+
+// TestTLSConfig_callbacks checks callbacks of TLS configs
+// are kept by Server and Client.
+func TestTLSConfig_callbacks(t *testing.T) {
+	serverCert, clientCert := selfSigned(t, "server.example.org"), selfSigned(t, "client")
+	cas := x509.NewCertPool()
+	cas.AddCert(clientCert.Leaf)
+
+	fired := map[string]*int32{}
+	for _, name := range []string{
+		"server GetConfigForClient", "server VerifyPeerCertificate", "server VerifyConnection",
+		"client VerifyPeerCertificate", "client VerifyConnection", "client GetClientCertificate",
+	} {
+		fired[name] = new(int32)
+	}
+	fire := func(name string) { atomic.AddInt32(fired[name], 1) }
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    cas,
+		VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+			fire("server VerifyPeerCertificate")
+			return nil
+		},
+		VerifyConnection: func(tls.ConnectionState) error {
+			fire("server VerifyConnection")
+			return nil
+		},
+	}
+	server := &socketman.Server{Config: socketman.Config{TLSConfig: &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			fire("server GetConfigForClient")
+			return serverConfig, nil
+		},
+	}}}
+	defer serve(t, server, named("ok", 0))()
+
+	var keyLog bytes.Buffer
+	client := vhostClient("server.example.org", &serverCert)
+	client.Config.TLSConfig.KeyLogWriter = &keyLog
+	client.Config.TLSConfig.VerifyPeerCertificate = func([][]byte, [][]*x509.Certificate) error {
+		fire("client VerifyPeerCertificate")
+		return nil
+	}
+	client.Config.TLSConfig.VerifyConnection = func(tls.ConnectionState) error {
+		fire("client VerifyConnection")
+		return nil
+	}
+	client.Config.TLSConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		fire("client GetClientCertificate")
+		return &clientCert, nil
+	}
+	if !connects(client) {
+		t.Fatal("connect failed")
+	}
+	for name, n := range fired {
+		if atomic.LoadInt32(n) == 0 {
+			t.Errorf("%s was not called", name)
+		}
+	}
+	if !bytes.Contains(keyLog.Bytes(), []byte("CLIENT_HANDSHAKE_TRAFFIC_SECRET")) {
+		t.Errorf("KeyLogWriter was not written to, got %q", keyLog.String())
+	}
+
+	// with pins, VerifyConnection is still called.
+	atomic.StoreInt32(fired["client VerifyConnection"], 0)
+	client.Pins = []string{socketman.SPKIPin(serverCert.Leaf)}
+	if !connects(client) || atomic.LoadInt32(fired["client VerifyConnection"]) == 0 {
+		t.Fatal("VerifyConnection should be called with Pins")
+	}
+}
+
+// TestTLSConfig_serverName checks certificates are verified for the
+// address given to Connect, not the address it resolves to.
+func TestTLSConfig_serverName(t *testing.T) {
+	cert := selfSigned(t, "server.example.org")
+	server := &socketman.Server{Config: socketman.Config{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}}}
+	defer serve(t, server, named("ok", 0))()
+
+	tests := map[string]string{
+		"server.example.org:1234":            addr,
+		"_socketman._tcp.server.example.org": addr,
+	}
+	for name := range tests {
+		client := vhostClient("", &cert)
+		client.Resolver = socketman.StaticResolver{name: {tests[name]}}
+		var answer []byte
+		err := client.ConnectFunc(name, func(c io.ReadWriter) {
+			answer, _ = io.ReadAll(c)
+		})
+		if err != nil || string(answer) != "ok:" {
+			t.Fatalf("%s: expected to connect, got %q, %v", name, answer, err)
+		}
+	}
+}
+
+// TestTLSConfig_server checks callbacks set on the
+// Server's own TLSConfig are kept.
+func TestTLSConfig_server(t *testing.T) {
+	serverCert, clientCert := selfSigned(t, "server.example.org"), selfSigned(t, "client")
+	cas := x509.NewCertPool()
+	cas.AddCert(clientCert.Leaf)
+	var verifyPeer, verifyConnection int32
+	var keyLog bytes.Buffer
+	server := &socketman.Server{Config: socketman.Config{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    cas,
+		KeyLogWriter: &keyLog,
+		VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+			atomic.AddInt32(&verifyPeer, 1)
+			return nil
+		},
+		VerifyConnection: func(tls.ConnectionState) error {
+			atomic.AddInt32(&verifyConnection, 1)
+			return nil
+		},
+	}}}
+	defer serve(t, server, named("ok", 0))()
+
+	client := vhostClient("server.example.org", &serverCert)
+	client.Config.TLSConfig.Certificates = []tls.Certificate{clientCert}
+	if !connects(client) {
+		t.Fatal("connect failed")
+	}
+	server.Shutdown(context.Background()) // done with keyLog
+	if atomic.LoadInt32(&verifyPeer) == 0 {
+		t.Error("VerifyPeerCertificate was not called")
+	}
+	if atomic.LoadInt32(&verifyConnection) == 0 {
+		t.Error("VerifyConnection was not called")
+	}
+	if !bytes.Contains(keyLog.Bytes(), []byte("SERVER_HANDSHAKE_TRAFFIC_SECRET")) {
+		t.Errorf("KeyLogWriter was not written to, got %q", keyLog.String())
+	}
+}
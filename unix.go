@@ -0,0 +1,167 @@
+package socketman
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//unixScheme prefixes unix domain socket addresses, like in
+//"unix:///run/socketman.sock" or, for the linux abstract
+//namespace, "unix://@socketman".
+const unixScheme = "unix://"
+
+//splitAddr returns the network and address to use for addr.
+func splitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixScheme) {
+		return "unix", strings.TrimPrefix(addr, unixScheme)
+	}
+	return "tcp", addr
+}
+
+//UnixSocket configures socket files created by ListenAndServe
+//on unix:// addresses. It has no effect on abstract sockets.
+type UnixSocket struct {
+	//Mode, if non zero, is applied to the socket file.
+	Mode os.FileMode
+
+	//Owner and Group, if set, are the user and group the
+	//socket file will belong to; as names or numeric ids.
+	Owner string
+	Group string
+}
+
+//listenUnix listens on the unix socket path, set up with u.
+//
+//A stale socket file left by a dead process, refusing
+//connections, is removed first; other sockets are left untouched.
+func listenUnix(path string, u UnixSocket) (net.Listener, error) {
+	abstract := strings.HasPrefix(path, "@")
+	if !abstract {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if abstract {
+		return l, nil
+	}
+	if err := u.apply(path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("socketman: %s exists and is not a socket", path)
+	}
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("socketman: %s is in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		// maybe a busy or unreachable listener.
+		return fmt.Errorf("socketman: %s may be in use: %w", path, err)
+	}
+	return os.Remove(path)
+}
+
+func (u UnixSocket) apply(path string) error {
+	if u.Mode != 0 {
+		if err := os.Chmod(path, u.Mode); err != nil {
+			return err
+		}
+	}
+	if u.Owner == "" && u.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if u.Owner != "" {
+		id, err := lookupID(u.Owner, func(name string) (string, error) {
+			usr, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return usr.Uid, nil
+		})
+		if err != nil {
+			return err
+		}
+		uid = id
+	}
+	if u.Group != "" {
+		id, err := lookupID(u.Group, func(name string) (string, error) {
+			grp, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return grp.Gid, nil
+		})
+		if err != nil {
+			return err
+		}
+		gid = id
+	}
+	return os.Chown(path, uid, gid)
+}
+
+//lookupID returns the numeric id of name, using lookup
+//when name is not a number.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+//PeerCred holds the credentials of the process on the other end
+//of a unix domain socket, at the time it connected.
+type PeerCred struct {
+	PID int
+	UID int
+	GID int
+}
+
+//ErrNotUnix is returned when unix socket only information
+//is asked about another kind of connection.
+var ErrNotUnix = errors.New("socketman: not a unix socket connection")
+
+//PeerCredentials returns the credentials of the peer of a connection
+//handed to a Handler. The connection must be a unix socket.
+//
+//Peer credentials are only supported on linux.
+func PeerCredentials(rw io.ReadWriter) (*PeerCred, error) {
+	c, ok := connOf(rw)
+	if !ok {
+		return nil, errors.New("socketman: not a socketman connection")
+	}
+	uc, ok := rawConn(c.netCon).(*net.UnixConn)
+	if !ok {
+		return nil, ErrNotUnix
+	}
+	return peerCred(uc)
+}
@@ -0,0 +1,176 @@
+package socketman_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+)
+
+func TestListenAndServe_unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socketman.sock")
+	addr := "unix://" + path
+
+	testEchoServerAt(t, addr, &socketman.Server{}, addr, &socketman.Client{})
+	testEchoClientAt(t, addr, &socketman.Server{}, addr, &socketman.Client{})
+}
+
+func TestListenAndServe_unix_stale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socketman.sock")
+	addr := "unix://" + path
+
+	// leave a socket file behind, like a crashed server would.
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("stale socket should exist: %s", err)
+	}
+
+	testEchoServerAt(t, addr, &socketman.Server{}, addr, &socketman.Client{})
+
+	// a regular file must not be removed.
+	if err := os.WriteFile(path, []byte("precious"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := &socketman.Server{}
+	if err := s.ListenAndServeFunc(addr, echoHandler); err == nil {
+		t.Fatal("listening over a regular file should fail")
+	}
+	s.Close()
+}
+
+func TestListenAndServe_unix_unreachable(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("root can connect to any socket")
+	}
+	path := filepath.Join(t.TempDir(), "socketman.sock")
+	addr := "unix://" + path
+
+	// a live socket this process can't connect to.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := os.Chmod(path, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &socketman.Server{}
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServeFunc(addr, echoHandler) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("listening over an unreachable socket should fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("listening over an unreachable socket should fail, it's serving")
+	}
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatalf("the socket should not be removed: %s", err)
+	}
+}
+
+func TestConnect_unix_handshakeTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socketman.sock")
+	// accepts connections and never answers.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	client := &socketman.Client{Config: socketman.Config{
+		HandshakeTimeout: 100 * time.Millisecond,
+		TLSConfig:        &tls.Config{InsecureSkipVerify: true},
+	}}
+	done := make(chan error, 1)
+	go func() { done <- client.ConnectFunc("unix://"+path, echoHandler) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("a stalled TLS handshake should fail connecting")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandshakeTimeout should bound handshakes over unix sockets")
+	}
+}
+
+func TestListenAndServe_unix_mode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socketman.sock")
+	addr := "unix://" + path
+	server := &socketman.Server{
+		UnixSocket: socketman.UnixSocket{
+			Mode:  0600,
+			Owner: strconv.Itoa(os.Getuid()),
+			Group: strconv.Itoa(os.Getgid()),
+		},
+	}
+
+	testAt(t, addr, server, echoHandler, addr, &socketman.Client{}, func(c io.ReadWriter) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0600 {
+			t.Errorf("expected socket file mode 0600, got %o", perm)
+		}
+	})
+}
+
+func TestListenAndServe_unix_peerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on linux")
+	}
+	addr := "unix://@socketman-test-" + strconv.Itoa(os.Getpid())
+
+	creds := make(chan *socketman.PeerCred, 1)
+	testAt(t, addr, &socketman.Server{}, func(c io.ReadWriter) {
+		cred, err := socketman.PeerCredentials(c)
+		if err != nil {
+			t.Errorf("PeerCredentials failed: %s", err)
+		}
+		creds <- cred
+	}, addr, &socketman.Client{}, func(c io.ReadWriter) {
+		c.Read(make([]byte, 1)) // wait for server to hang up
+	})
+
+	cred := <-creds
+	if cred == nil {
+		t.FailNow()
+	}
+	if cred.PID != os.Getpid() || cred.UID != os.Getuid() || cred.GID != os.Getgid() {
+		t.Fatalf("unexpected peer credentials: %+v", cred)
+	}
+
+	// tcp connections don't have any.
+	test(t, &socketman.Server{}, func(c io.ReadWriter) {
+		if _, err := socketman.PeerCredentials(c); err != socketman.ErrNotUnix {
+			t.Errorf("expected ErrNotUnix, got %v", err)
+		}
+	}, &socketman.Client{}, func(c io.ReadWriter) {
+		c.Read(make([]byte, 1))
+	})
+}
@@ -0,0 +1,259 @@
+package socketman
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Environment variables used to hand listeners over to a new process.
+//The address of the i-th listener is in upgradeAddrEnv + i: no
+//separator can be relied on, unix paths can contain anything.
+const (
+	upgradeFdsEnv   = "SOCKETMAN_UPGRADE_FDS"
+	upgradeAddrEnv  = "SOCKETMAN_UPGRADE_ADDR_"
+	upgradeReadyEnv = "SOCKETMAN_UPGRADE_READY_FD"
+)
+
+//Upgrader allows to replace a running binary without ever
+//refusing a connection.
+//
+//Listeners are opened with Listen. When Upgrade is called, a new
+//process is started inheriting those listeners; Listen in the new
+//process returns the inherited listener instead of opening a new one.
+//Once the new process called Ready, Upgrade returns and the old
+//process can gracefully Shutdown its servers to drain ongoing
+//connections:
+//
+//	upg := &socketman.Upgrader{}
+//	l, err := upg.Listen(":8080")
+//	...
+//	go server.Serve(l, handler)
+//	upg.Ready() // tell our parent, if any, we are ready
+//	<-sighup
+//	if _, err := upg.Upgrade(); err == nil {
+//		server.Shutdown(ctx)
+//	}
+type Upgrader struct {
+	//Path is the binary of the new process.
+	//If empty the current executable is used.
+	Path string
+
+	//Args are the arguments of the new process, without
+	//the program name. If nil os.Args[1:] is used.
+	Args []string
+
+	//Env is appended to the current environment
+	//for the new process.
+	Env []string
+
+	//ReadyTimeout bounds the time a new process has
+	//to call Ready. Zero means one minute.
+	ReadyTimeout time.Duration
+
+	//TCP and UnixSocket set up listeners Listen opens, like
+	//Config.TCP and UnixSocket of a Server. Inherited listeners
+	//keep the options of the process which opened them.
+	TCP        TCPOptions
+	UnixSocket UnixSocket
+
+	once      sync.Once
+	inherited map[string][]net.Listener
+	ready     *os.File
+	initErr   error
+
+	// mu guards listeners
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+//init picks up what a parent process handed over.
+func (u *Upgrader) init() {
+	u.once.Do(func() {
+		u.listeners = map[string]net.Listener{}
+		fds, ready := os.Getenv(upgradeFdsEnv), os.Getenv(upgradeReadyEnv)
+		os.Unsetenv(upgradeFdsEnv)
+		os.Unsetenv(upgradeReadyEnv)
+		if fds == "" {
+			return
+		}
+		n, err := strconv.Atoi(fds)
+		if err != nil {
+			u.initErr = fmt.Errorf("socketman: invalid %s %q", upgradeFdsEnv, fds)
+			return
+		}
+		addrs := make([]string, n)
+		for i := range addrs {
+			addrs[i] = os.Getenv(upgradeAddrEnv + strconv.Itoa(i))
+			os.Unsetenv(upgradeAddrEnv + strconv.Itoa(i))
+		}
+		if fd, err := strconv.Atoi(ready); err == nil {
+			u.ready = os.NewFile(uintptr(fd), "ready")
+		}
+		u.inherited, u.initErr = inheritListeners(listenFdsStart, n, addrs)
+	})
+}
+
+//Listen returns a listener on addr; see Server.ListenAndServe
+//for the syntax of addr.
+//
+//If addr was handed over by a parent process, the inherited
+//listener is returned.
+func (u *Upgrader) Listen(addr string) (net.Listener, error) {
+	u.init()
+	if u.initErr != nil {
+		return nil, u.initErr
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if l, found := u.listeners[addr]; found {
+		return l, nil
+	}
+	var l net.Listener
+	if ls := u.inherited[addr]; len(ls) > 0 {
+		l = ls[0]
+		u.inherited[addr] = ls[1:]
+	} else {
+		var err error
+		l, err = listen(addr, u.TCP, u.UnixSocket)
+		if err != nil {
+			return nil, err
+		}
+	}
+	u.listeners[addr] = l
+	return l, nil
+}
+
+//Ready tells the parent process, if any, that this process
+//is ready to accept connections.
+//
+//Inherited listeners Listen was not called for are closed,
+//so clients are refused rather than left waiting.
+func (u *Upgrader) Ready() error {
+	u.init()
+	u.mu.Lock()
+	for addr, ls := range u.inherited {
+		for _, l := range ls {
+			l.Close()
+		}
+		delete(u.inherited, addr)
+	}
+	u.mu.Unlock()
+	if u.ready == nil {
+		return nil
+	}
+	_, err := u.ready.Write([]byte{1})
+	u.ready.Close()
+	u.ready = nil
+	return err
+}
+
+//Upgrade starts a new process handing over listeners opened
+//with Listen and waits for it to be Ready.
+//
+//Listeners of the current process are left open, it's up to the
+//caller to close or Shutdown the servers using them.
+//The new process is returned so it can be waited for or released.
+func (u *Upgrader) Upgrade() (*os.Process, error) {
+	u.init()
+	path := u.Path
+	if path == "" {
+		var err error
+		path, err = os.Executable()
+		if err != nil {
+			return nil, err
+		}
+	}
+	args := u.Args
+	if args == nil {
+		args = os.Args[1:]
+	}
+
+	u.mu.Lock()
+	var files []*os.File
+	var addrs []string
+	var unix []*net.UnixListener
+	for addr, l := range u.listeners {
+		f, err := listenerFile(l)
+		if err != nil {
+			u.mu.Unlock()
+			closeFiles(files)
+			return nil, fmt.Errorf("socketman: can't hand %s over: %s", addr, err)
+		}
+		files = append(files, f)
+		addrs = append(addrs, addr)
+		if ul, ok := l.(*net.UnixListener); ok {
+			unix = append(unix, ul)
+		}
+	}
+	u.mu.Unlock()
+	defer closeFiles(files)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(), u.Env...)
+	cmd.Env = append(cmd.Env,
+		upgradeFdsEnv+"="+strconv.Itoa(len(files)),
+		upgradeReadyEnv+"="+strconv.Itoa(listenFdsStart+len(files)),
+	)
+	for i, addr := range addrs {
+		cmd.Env = append(cmd.Env, upgradeAddrEnv+strconv.Itoa(i)+"="+addr)
+	}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := u.ReadyTimeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	r.SetReadDeadline(time.Now().Add(timeout))
+	_, err = r.Read(make([]byte, 1))
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if err == io.EOF {
+			return nil, errors.New("socketman: new process exited before being ready")
+		}
+		return nil, fmt.Errorf("socketman: new process not ready: %s", err)
+	}
+	for _, l := range unix {
+		// the new process now owns the socket file.
+		l.SetUnlinkOnClose(false)
+	}
+	return cmd.Process, nil
+}
+
+//listenerFile returns a duplicate of l's file descriptor.
+func listenerFile(l net.Listener) (*os.File, error) {
+	switch l := l.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	}
+	return nil, fmt.Errorf("unsupported listener type %T", l)
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
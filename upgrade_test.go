@@ -0,0 +1,303 @@
+package socketman_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/azr/socketman"
+)
+
+const upgradeAddr = "127.0.0.1:0"
+
+// TestUpgradeHelper is not a real test: it's the new process
+// started by TestUpgrade.
+func TestUpgradeHelper(t *testing.T) {
+	if os.Getenv("SOCKETMAN_UPGRADE_HELPER") != "1" {
+		t.Skip("helper process")
+	}
+	upg := &socketman.Upgrader{}
+	l, err := upg.Listen(upgradeAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socketman.Server{}
+	handler := socketman.HandlerFunc(func(c io.ReadWriter) {
+		io.WriteString(c, "child")
+	})
+	go s.Serve(l, handler)
+	if unix := os.Getenv("SOCKETMAN_UPGRADE_HELPER_UNIX"); unix != "" {
+		l, err := upg.Listen(unix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(l, handler)
+	}
+	if err := upg.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	select {} // until killed
+}
+
+func readGreeting(t *testing.T, addr string) string {
+	out := make([]byte, 6)
+	var n int
+	err := (&socketman.Client{}).ConnectFunc(addr, func(c io.ReadWriter) {
+		n, _ = io.ReadFull(c, out)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out[:n])
+}
+
+func TestUpgrade(t *testing.T) {
+	upg := &socketman.Upgrader{
+		Path: os.Args[0],
+		Args: []string{"-test.run=^TestUpgradeHelper$"},
+		Env:  []string{"SOCKETMAN_UPGRADE_HELPER=1"},
+	}
+	l, err := upg.Listen(upgradeAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	release := make(chan struct{})
+	s := &socketman.Server{}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(l, socketman.HandlerFunc(func(c io.ReadWriter) {
+			io.WriteString(c, "parent")
+			<-release
+		}))
+	}()
+
+	// a long running connection to the old process.
+	longDone := make(chan string)
+	go func() {
+		longDone <- readGreeting(t, addr)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	child, err := upg.Upgrade()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		child.Kill()
+		child.Wait()
+	}()
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	if err := <-served; err != socketman.ErrServerClosed {
+		t.Fatalf("Serve should return ErrServerClosed, got %v", err)
+	}
+
+	// new connections go to the new process ...
+	for i := 0; i < 3; i++ {
+		if greeting := readGreeting(t, addr); greeting != "child" {
+			t.Fatalf("expected new process to answer, got %q", greeting)
+		}
+	}
+
+	// ... while the old one drains.
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned with an ongoing connection: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if greeting := <-longDone; greeting != "parent" {
+		t.Fatalf("expected old process to answer, got %q", greeting)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown failed: %s", err)
+	}
+}
+
+func TestShutdown_timeout(t *testing.T) {
+	s := &socketman.Server{}
+	release := make(chan struct{})
+	defer close(release)
+	go s.ListenAndServeFunc(addr, func(c io.ReadWriter) {
+		<-release
+	})
+	time.Sleep(time.Millisecond)
+	go (&socketman.Client{}).ConnectFunc(addr, func(c io.ReadWriter) {
+		c.Read(make([]byte, 1))
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected Shutdown to time out, got %v", err)
+	}
+}
+
+// TestUpgrade_unix hands over a unix socket whose
+// path contains what could be a separator.
+func TestUpgrade_unix(t *testing.T) {
+	unix := "unix://" + filepath.Join(t.TempDir(), "a,b:c.sock")
+	upg := &socketman.Upgrader{
+		Path: os.Args[0],
+		Args: []string{"-test.run=^TestUpgradeHelper$"},
+		Env:  []string{"SOCKETMAN_UPGRADE_HELPER=1", "SOCKETMAN_UPGRADE_HELPER_UNIX=" + unix},
+	}
+	tcp, err := upg.Listen(upgradeAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	l, err := upg.Listen(unix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := upg.Upgrade()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		child.Kill()
+		child.Wait()
+	}()
+	// the socket file belongs to the new process now.
+	l.Close()
+	for _, addr := range []string{tcp.Addr().String(), unix} {
+		if greeting := readGreeting(t, addr); greeting != "child" {
+			t.Fatalf("expected new process to answer on %s, got %q", addr, greeting)
+		}
+	}
+}
+
+// TestUpgrade_unclaimed hands over a unix socket
+// the new process does not listen on.
+func TestUpgrade_unclaimed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socket")
+	upg := &socketman.Upgrader{
+		Path: os.Args[0],
+		Args: []string{"-test.run=^TestUpgradeHelper$"},
+		Env:  []string{"SOCKETMAN_UPGRADE_HELPER=1"},
+	}
+	tcp, err := upg.Listen(upgradeAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	l, err := upg.Listen("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := upg.Upgrade()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		child.Kill()
+		child.Wait()
+	}()
+	l.Close()
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		t.Fatal("nobody accepts on the socket, connecting should be refused")
+	}
+}
+
+func TestUpgrade_listenOptions(t *testing.T) {
+	var controlled bool
+	upg := &socketman.Upgrader{
+		TCP: socketman.TCPOptions{Control: func(network, address string, c syscall.RawConn) error {
+			controlled = true
+			return nil
+		}},
+		UnixSocket: socketman.UnixSocket{Mode: 0600},
+	}
+	tcp, err := upg.Listen(upgradeAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	if !controlled {
+		t.Error("TCP.Control should be called for TCP listeners")
+	}
+
+	path := filepath.Join(t.TempDir(), "socket")
+	l, err := upg.Listen("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("expected socket file mode 0600, got %o", perm)
+	}
+}
+
+func TestUpgrade_failed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socket")
+	upg := &socketman.Upgrader{
+		Path: os.Args[0],
+		// without SOCKETMAN_UPGRADE_HELPER, exits without calling Ready.
+		Args: []string{"-test.run=^TestUpgradeHelper$"},
+	}
+	l, err := upg.Listen("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upg.Upgrade(); err == nil {
+		t.Fatal("upgrade should fail")
+	}
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file should be removed after a failed upgrade, got %v", err)
+	}
+}
+
+// slowListener takes delay to hand accepted connections over.
+type slowListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l slowListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	time.Sleep(l.delay)
+	return c, err
+}
+
+func TestShutdown_accepting(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socketman.Server{}
+	release := make(chan struct{})
+	defer close(release)
+	go s.Serve(slowListener{l, 50 * time.Millisecond}, socketman.HandlerFunc(func(c io.ReadWriter) {
+		<-release
+	}))
+	time.Sleep(10 * time.Millisecond)
+	go (&socketman.Client{}).ConnectFunc(addr, func(c io.ReadWriter) {
+		c.Read(make([]byte, 1))
+	})
+	time.Sleep(10 * time.Millisecond) // accepted, not handed over yet
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown should wait for the connection being accepted, got %v", err)
+	}
+}
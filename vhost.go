@@ -0,0 +1,66 @@
+package socketman
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+//VirtualHost configures connections of a Server asking
+//for a server name, see Server.VirtualHosts.
+type VirtualHost struct {
+	//Config replaces the Server's for these connections.
+	//Its TLSConfig, if set, is used for the handshake:
+	//certificates, client authentication and so on.
+	//Otherwise the Server's TLSConfig is. If Authorize is
+	//nil, the Server's Authorize is used.
+	Config
+
+	//Handler, if set, replaces the handler
+	//the Server was started with.
+	Handler Handler
+}
+
+//virtualHost returns the virtual host of name, if any.
+func (s *Server) virtualHost(name string) *VirtualHost {
+	if name == "" || len(s.VirtualHosts) == 0 {
+		return nil
+	}
+	name = strings.ToLower(name)
+	if vh, ok := s.VirtualHosts[name]; ok {
+		return vh
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return s.VirtualHosts["*"+name[i:]]
+	}
+	return nil
+}
+
+//getConfigForClient selects the TLS config of the
+//virtual host clients ask for.
+func (s *Server) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	vh := s.virtualHost(hello.ServerName)
+	if vh == nil && s.RejectUnknownHosts {
+		return nil, fmt.Errorf("socketman: unknown server name %q", hello.ServerName)
+	}
+	if vh == nil || vh.TLSConfig == nil {
+		if base := s.Config.TLSConfig; base.GetConfigForClient != nil {
+			return base.GetConfigForClient(hello)
+		}
+		return nil, nil
+	}
+	return configForClient(vh.TLSConfig, hello)
+}
+
+//configForClient returns the config of a handshake using config,
+//calling its GetConfigForClient, as tls.Server does not for
+//configs GetConfigForClient returned.
+func configForClient(config *tls.Config, hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if config.GetConfigForClient != nil {
+		c, err := config.GetConfigForClient(hello)
+		if c != nil || err != nil {
+			return c, err
+		}
+	}
+	return config, nil
+}
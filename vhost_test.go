@@ -0,0 +1,188 @@
+package socketman_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+)
+
+// vhostClient asks for serverName, and only trusts
+// cert if set.
+func vhostClient(serverName string, cert *tls.Certificate) *socketman.Client {
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+	if cert != nil {
+		config.InsecureSkipVerify = false
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AddCert(cert.Leaf)
+	}
+	return &socketman.Client{Config: socketman.Config{TLSConfig: config}}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	defaultCert := selfSigned(t, "default.example.com", "b.example.com", "x.y.b.example.com")
+	aCert := selfSigned(t, "a.example.com")
+	bCert := selfSigned(t, "*.b.example.com")
+	server := &socketman.Server{
+		Config: socketman.Config{TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{defaultCert},
+		}},
+		VirtualHosts: map[string]*socketman.VirtualHost{
+			"a.example.com": {
+				Config: socketman.Config{
+					TLSConfig:  &tls.Config{Certificates: []tls.Certificate{aCert}},
+					CypherPool: aespool,
+				},
+				Handler: named("a", 0),
+			},
+			"*.b.example.com": {
+				Config: socketman.Config{
+					TLSConfig: &tls.Config{Certificates: []tls.Certificate{bCert}},
+				},
+			},
+		},
+	}
+	defer serve(t, server, named("default", 0))()
+
+	tests := []struct {
+		serverName string
+		cert       *tls.Certificate // trusted by the client
+		answer     string
+	}{
+		{"a.example.com", &aCert, "a:"},
+		{"A.Example.COM", &aCert, "a:"},
+		{"x.b.example.com", &bCert, "default:"},
+		{"b.example.com", &defaultCert, "default:"},
+		{"x.y.b.example.com", &defaultCert, "default:"},
+		{"", nil, "default:"},
+	}
+	for _, tt := range tests {
+		client := vhostClient(tt.serverName, tt.cert)
+		if tt.answer == "a:" {
+			// the virtual host's CypherPool is used.
+			client.Config.CypherPool = aespool
+		}
+		if answer := route(t, client, ""); answer != tt.answer {
+			t.Errorf("%q: expected the %q handler, got %q", tt.serverName, tt.answer, answer)
+		}
+	}
+}
+
+func TestVirtualHosts_reject(t *testing.T) {
+	server := &socketman.Server{
+		Config: socketman.Config{TLSConfig: &tls.Config{}},
+		VirtualHosts: map[string]*socketman.VirtualHost{
+			"public.example.com": {
+				Config: socketman.Config{TLSConfig: &tls.Config{
+					Certificates: []tls.Certificate{selfSigned(t, "public.example.com")},
+				}},
+			},
+			"private.example.com": {
+				Config: socketman.Config{TLSConfig: &tls.Config{
+					Certificates: []tls.Certificate{selfSigned(t, "private.example.com")},
+					ClientAuth:   tls.RequireAnyClientCert,
+				}},
+			},
+		},
+		RejectUnknownHosts: true,
+	}
+	defer serve(t, server, named("ok", 0))()
+
+	if answer := route(t, vhostClient("public.example.com", nil), ""); answer != "ok:" {
+		t.Fatalf("known host should be served, got %q", answer)
+	}
+	for _, name := range []string{"unknown.example.com", ""} {
+		err := vhostClient(name, nil).ConnectFunc(addr, func(c io.ReadWriter) {
+			t.Errorf("%q: handler should not run", name)
+		})
+		if err == nil {
+			t.Errorf("%q: unknown host should be rejected", name)
+		}
+	}
+	// per host client authentication: the handshake completes client
+	// side, the server refuses at its first read.
+	var answer []byte
+	vhostClient("private.example.com", nil).ConnectFunc(addr, func(c io.ReadWriter) {
+		answer, _ = io.ReadAll(c)
+	})
+	if len(answer) > 0 {
+		t.Fatalf("client without certificate should be refused, got %q", answer)
+	}
+}
+
+func TestVirtualHosts_timeout(t *testing.T) {
+	server := &socketman.Server{
+		Config: socketman.Config{
+			TLSConfig:   &tls.Config{Certificates: []tls.Certificate{selfSigned(t, "slow.example.com")}},
+			IdleTimeout: 50 * time.Millisecond,
+		},
+		VirtualHosts: map[string]*socketman.VirtualHost{
+			// waits for a compression offer the client never sends.
+			"slow.example.com": {Config: socketman.Config{
+				Compressors: []socketman.Compressor{socketman.DeflateCompressor{}},
+			}},
+			"idle.example.com": {Config: socketman.Config{
+				Compressors: []socketman.Compressor{socketman.DeflateCompressor{}},
+				IdleTimeout: 50 * time.Millisecond,
+			}},
+		},
+	}
+	defer serve(t, server, named("ok", 0))()
+
+	for _, name := range []string{"slow.example.com", "idle.example.com"} {
+		client := vhostClient(name, nil)
+		client.Config.ReadTimeout = time.Second
+		start := time.Now()
+		client.ConnectFunc(addr, func(c io.ReadWriter) {
+			if _, err := c.Read(make([]byte, 1)); err == nil {
+				t.Errorf("%s: read should fail", name)
+			}
+		})
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Errorf("%s: stalled negotiation took %s to time out", name, d)
+		}
+	}
+}
+
+func TestVirtualHosts_requireTLS(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &socketman.Server{RejectUnknownHosts: true}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(l, named("ok", 0)) }()
+	select {
+	case err := <-done:
+		if err == nil || err == socketman.ErrServerClosed {
+			t.Fatalf("expected a configuration error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		server.Close()
+		t.Fatal("RejectUnknownHosts without TLSConfig should fail")
+	}
+}
+
+// TestVirtualHosts_noTimeouts checks the server's setup deadline
+// does not outlive the setup of a virtual host without timeouts.
+func TestVirtualHosts_noTimeouts(t *testing.T) {
+	server := &socketman.Server{
+		Config: socketman.Config{
+			TLSConfig:        &tls.Config{Certificates: []tls.Certificate{selfSigned(t, "a.example.com")}},
+			HandshakeTimeout: 100 * time.Millisecond,
+		},
+		VirtualHosts: map[string]*socketman.VirtualHost{"a.example.com": {}},
+	}
+	var err error
+	defer serve(t, server, socketman.HandlerFunc(func(c io.ReadWriter) {
+		time.Sleep(300 * time.Millisecond)
+		_, err = io.WriteString(c, "ok:")
+	}))()
+	if !connects(vhostClient("a.example.com", nil)) {
+		t.Fatalf("handler write failed: %v", err)
+	}
+}
@@ -0,0 +1,491 @@
+package socketman
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+//WebSocket message types, as defined in RFC 6455.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+
+	continuationFrame = 0
+)
+
+//WebSocket close codes, as defined in RFC 6455.
+const (
+	CloseNormalClosure      = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatusReceived   = 1005
+	CloseAbnormalClosure    = 1006
+	CloseInvalidPayload     = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalError      = 1011
+)
+
+//maxControlPayload is the maximum payload of control frames.
+const maxControlPayload = 125
+
+//ErrCloseSent is returned when writing to a websocket
+//connection after a close frame was sent.
+var ErrCloseSent = errors.New("socketman: websocket close frame already sent")
+
+//CloseError is returned when a websocket connection is closed,
+//by the peer or because the peer violated the protocol.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return "socketman: websocket closed: " + strconv.Itoa(e.Code) + " " + e.Text
+}
+
+//WebSocketConn is a websocket connection.
+//
+//Read and Write make it usable as a stream: Read returns the payload
+//of received data messages one after another, Write sends one
+//message of WebSocketConfig.MessageType per call.
+//ReadMessage and WriteMessage give access to messages.
+//
+//Control frames are handled while reading: pings are answered and
+//close frames are echoed.
+//One goroutine can read while others write.
+type WebSocketConn struct {
+	net.Conn
+	br          *bufio.Reader
+	server      bool
+	config      WebSocketConfig
+	subprotocol string
+	deflate     *wsDeflate // nil unless permessage-deflate was negotiated
+
+	readBuf []byte // rest of the message being Read
+	readErr error
+
+	wmu       sync.Mutex // guards writes and closeSent
+	closeSent bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newWebSocketConn(c net.Conn, br *bufio.Reader, server bool, config WebSocketConfig, subprotocol string, deflate *deflateParams) *WebSocketConn {
+	ws := &WebSocketConn{
+		Conn:        c,
+		br:          br,
+		server:      server,
+		config:      config,
+		subprotocol: subprotocol,
+	}
+	if deflate != nil {
+		ws.deflate = newWSDeflate(*deflate, server, config.Compression)
+	}
+	return ws
+}
+
+//WebSocket returns the websocket connection of a connection
+//handed to a Handler.
+func WebSocket(rw io.ReadWriter) (*WebSocketConn, bool) {
+	c, ok := connOf(rw)
+	if !ok {
+		return nil, false
+	}
+	ws, ok := c.netCon.(*WebSocketConn)
+	return ws, ok
+}
+
+//NetConn returns the underlying connection.
+func (c *WebSocketConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+//Subprotocol returns the negotiated subprotocol, if any.
+func (c *WebSocketConn) Subprotocol() string {
+	return c.subprotocol
+}
+
+//Compressed tells whether permessage-deflate was negotiated.
+func (c *WebSocketConn) Compressed() bool {
+	return c.deflate != nil
+}
+
+//Read reads payload data of received messages.
+//It returns io.EOF after a normal closure.
+func (c *WebSocketConn) Read(b []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		_, p, err := c.ReadMessage()
+		if err != nil {
+			if ce, ok := err.(*CloseError); ok {
+				switch ce.Code {
+				case CloseNormalClosure, CloseGoingAway, CloseNoStatusReceived:
+					return 0, io.EOF
+				}
+			}
+			return 0, err
+		}
+		c.readBuf = p
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+//Write sends b as one message.
+func (c *WebSocketConn) Write(b []byte) (int, error) {
+	typ := c.config.MessageType
+	if typ == 0 {
+		typ = BinaryMessage
+	}
+	if err := c.WriteMessage(typ, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+//Close sends a normal closure close frame, if none was sent
+//yet, and closes the connection.
+func (c *WebSocketConn) Close() error {
+	c.writeClose(CloseNormalClosure, "")
+	return c.closeConn()
+}
+
+//closeConn closes the underlying connection once.
+func (c *WebSocketConn) closeConn() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+//ReadMessage reads the next data message, handling
+//control frames received in between.
+func (c *WebSocketConn) ReadMessage() (messageType int, p []byte, err error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	messageType, p, err = c.readMessage()
+	if err != nil {
+		c.readErr = err
+	}
+	return messageType, p, err
+}
+
+func (c *WebSocketConn) readMessage() (int, []byte, error) {
+	max := c.config.maxMessageSize()
+	var typ int
+	var msg []byte
+	var compressed bool
+	for {
+		h, err := c.readHeader()
+		if err != nil {
+			return 0, nil, err
+		}
+		if h.rsv == rsv1 && c.deflate != nil && (h.opcode == TextMessage || h.opcode == BinaryMessage) {
+			compressed = true
+		} else if h.rsv != 0 {
+			return 0, nil, c.fail(CloseProtocolError, "reserved bits set")
+		}
+
+		switch h.opcode {
+		case PingMessage, PongMessage, CloseMessage:
+			if !h.fin {
+				return 0, nil, c.fail(CloseProtocolError, "fragmented control frame")
+			}
+			if h.length > maxControlPayload {
+				return 0, nil, c.fail(CloseProtocolError, "control frame too long")
+			}
+			payload, err := c.readPayload(h)
+			if err != nil {
+				return 0, nil, err
+			}
+			switch h.opcode {
+			case PingMessage:
+				if err := c.WriteMessage(PongMessage, payload); err != nil && err != ErrCloseSent {
+					return 0, nil, err
+				}
+			case CloseMessage:
+				return 0, nil, c.handleClose(payload)
+			}
+			continue
+		case TextMessage, BinaryMessage:
+			if typ != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected continuation frame")
+			}
+			typ = int(h.opcode)
+		case continuationFrame:
+			if typ == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, "unknown opcode "+strconv.Itoa(int(h.opcode)))
+		}
+
+		if h.length > uint64(max-len(msg)) {
+			return 0, nil, c.fail(CloseMessageTooBig, "message exceeds "+strconv.Itoa(max)+" bytes")
+		}
+		payload, err := c.readPayload(h)
+		if err != nil {
+			return 0, nil, err
+		}
+		msg = append(msg, payload...)
+		if !h.fin {
+			continue
+		}
+		if compressed {
+			msg, err = c.deflate.decompress(msg, max)
+			if err == errMessageTooBig {
+				return 0, nil, c.fail(CloseMessageTooBig, "message exceeds "+strconv.Itoa(max)+" bytes")
+			} else if err != nil {
+				return 0, nil, c.fail(CloseInvalidPayload, "invalid compressed message")
+			}
+		}
+		if typ == TextMessage && !utf8.Valid(msg) {
+			return 0, nil, c.fail(CloseInvalidPayload, "invalid utf-8 in text message")
+		}
+		if msg == nil {
+			msg = []byte{}
+		}
+		return typ, msg, nil
+	}
+}
+
+//rsv1 marks compressed messages, see RFC 7692.
+const rsv1 = 0x4
+
+//wsHeader is a decoded frame header.
+type wsHeader struct {
+	fin    bool
+	rsv    byte // the three reserved bits
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length uint64
+}
+
+func (c *WebSocketConn) readHeader() (wsHeader, error) {
+	var h wsHeader
+	var b [8]byte
+	if _, err := io.ReadFull(c.br, b[:2]); err != nil {
+		return h, err
+	}
+	h.fin = b[0]&0x80 != 0
+	h.rsv = (b[0] >> 4) & 0x7
+	h.opcode = b[0] & 0xf
+	h.masked = b[1]&0x80 != 0
+	h.length = uint64(b[1] & 0x7f)
+	switch h.length {
+	case 126:
+		if _, err := io.ReadFull(c.br, b[:2]); err != nil {
+			return h, err
+		}
+		h.length = uint64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.br, b[:8]); err != nil {
+			return h, err
+		}
+		h.length = binary.BigEndian.Uint64(b[:8])
+		if h.length>>63 != 0 {
+			return h, c.fail(CloseProtocolError, "invalid frame length")
+		}
+	}
+	if h.masked != c.server {
+		if c.server {
+			return h, c.fail(CloseProtocolError, "unmasked client frame")
+		}
+		return h, c.fail(CloseProtocolError, "masked server frame")
+	}
+	if h.masked {
+		if _, err := io.ReadFull(c.br, h.mask[:]); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+func (c *WebSocketConn) readPayload(h wsHeader) ([]byte, error) {
+	p := make([]byte, h.length)
+	if _, err := io.ReadFull(c.br, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if h.masked {
+		maskBytes(h.mask, p)
+	}
+	return p, nil
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i&3]
+	}
+}
+
+//validCloseCode tells whether code can be sent in a close frame.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+//handleClose answers a close frame with payload.
+func (c *WebSocketConn) handleClose(payload []byte) error {
+	code := CloseNoStatusReceived
+	var text string
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "invalid close frame payload")
+	case len(payload) >= 2:
+		code = int(binary.BigEndian.Uint16(payload))
+		if !validCloseCode(code) {
+			return c.fail(CloseProtocolError, "invalid close code "+strconv.Itoa(code))
+		}
+		if !utf8.Valid(payload[2:]) {
+			return c.fail(CloseInvalidPayload, "invalid utf-8 in close reason")
+		}
+		text = string(payload[2:])
+	}
+	if code == CloseNoStatusReceived {
+		c.writeClose(0, "")
+	} else {
+		c.writeClose(code, "")
+	}
+	c.closeConn()
+	return &CloseError{Code: code, Text: text}
+}
+
+//fail closes the connection because the peer did something wrong.
+func (c *WebSocketConn) fail(code int, text string) error {
+	c.writeClose(code, text)
+	c.closeConn()
+	return &CloseError{Code: code, Text: text}
+}
+
+//writeClose sends a close frame if none was sent yet.
+//A zero code sends an empty close frame.
+func (c *WebSocketConn) writeClose(code int, text string) {
+	var payload []byte
+	if code != 0 {
+		if len(text) > maxControlPayload-2 {
+			text = text[:maxControlPayload-2]
+		}
+		payload = make([]byte, 2, 2+len(text))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, text...)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return
+	}
+	c.closeSent = true
+	c.writeFrame(true, 0, CloseMessage, payload)
+}
+
+//WriteMessage sends a message of type messageType.
+//Data messages larger than WebSocketConfig.FragmentSize are
+//sent in several frames, after being compressed if
+//permessage-deflate was negotiated.
+//Control messages can be sent too; a close message should rather
+//be sent by closing the connection.
+func (c *WebSocketConn) WriteMessage(messageType int, p []byte) error {
+	switch messageType {
+	case TextMessage, BinaryMessage:
+	case PingMessage, PongMessage, CloseMessage:
+		if len(p) > maxControlPayload {
+			return fmt.Errorf("socketman: control message too long: %d bytes", len(p))
+		}
+	default:
+		return fmt.Errorf("socketman: unknown message type %d", messageType)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if messageType == CloseMessage {
+		c.closeSent = true
+	}
+
+	opcode := byte(messageType)
+	var rsv byte
+	if c.deflate != nil && opcode < CloseMessage && len(p) >= c.deflate.threshold {
+		compressed, err := c.deflate.compress(p)
+		if err != nil {
+			return err
+		}
+		p, rsv = compressed, rsv1
+	}
+	fragment := c.config.FragmentSize
+	for fragment > 0 && len(p) > fragment && opcode < CloseMessage {
+		if err := c.writeFrame(false, rsv, opcode, p[:fragment]); err != nil {
+			return err
+		}
+		p = p[fragment:]
+		opcode, rsv = continuationFrame, 0
+	}
+	return c.writeFrame(true, rsv, opcode, p)
+}
+
+//writeFrame writes a single frame, c.wmu must be held.
+func (c *WebSocketConn) writeFrame(fin bool, rsv byte, opcode byte, payload []byte) error {
+	var hdr [14]byte
+	hdr[0] = opcode | rsv<<4
+	if fin {
+		hdr[0] |= 0x80
+	}
+	n := 2
+	switch l := len(payload); {
+	case l <= 125:
+		hdr[1] = byte(l)
+	case l <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+		n += 2
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+		n += 8
+	}
+
+	frame := make([]byte, 0, n+4+len(payload))
+	if c.server {
+		frame = append(frame, hdr[:n]...)
+		frame = append(frame, payload...)
+	} else {
+		// clients mask what they send
+		hdr[1] |= 0x80
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, hdr[:n]...)
+		frame = append(frame, mask[:]...)
+		frame = append(frame, payload...)
+		maskBytes(mask, frame[n+4:])
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
@@ -0,0 +1,278 @@
+package socketman
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//WebSocketCompression configures the permessage-deflate
+//extension (RFC 7692). It's used when both ends support it.
+type WebSocketCompression struct {
+	//Level is the compress/flate compression level.
+	//Zero means flate.DefaultCompression.
+	Level int
+
+	//Threshold is the size under which messages are sent
+	//uncompressed.
+	Threshold int
+
+	//ServerNoContextTakeover and ClientNoContextTakeover make
+	//the server, or the client, reset its compression context after
+	//each message: compression gets worse but memory is saved.
+	//A server can only ask its client to do so, and a client can
+	//only ask its server.
+	ServerNoContextTakeover bool
+	ClientNoContextTakeover bool
+
+	//ClientMaxWindowBits, set by a server, and ServerMaxWindowBits,
+	//set by a client, ask the peer to compress using a sliding
+	//window of at most 2^bits bytes. Valid values are 8 to 15.
+	//
+	//compress/flate always compresses using a 32KB window
+	//so offers restricting ours are declined.
+	ClientMaxWindowBits int
+	ServerMaxWindowBits int
+}
+
+//deflateParams are negotiated permessage-deflate parameters.
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+}
+
+func (p deflateParams) String() string {
+	s := "permessage-deflate"
+	if p.serverNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if p.clientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	if p.serverMaxWindowBits != 0 {
+		s += "; server_max_window_bits=" + strconv.Itoa(p.serverMaxWindowBits)
+	}
+	if p.clientMaxWindowBits != 0 {
+		s += "; client_max_window_bits=" + strconv.Itoa(p.clientMaxWindowBits)
+	}
+	return s
+}
+
+//extensionOffer is one element of a Sec-WebSocket-Extensions header.
+type extensionOffer struct {
+	name   string
+	params map[string]string
+}
+
+func parseExtensions(h http.Header) []extensionOffer {
+	var offers []extensionOffer
+	for _, v := range h[http.CanonicalHeaderKey("Sec-Websocket-Extensions")] {
+		for _, ext := range strings.Split(v, ",") {
+			parts := strings.Split(ext, ";")
+			offer := extensionOffer{
+				name:   strings.TrimSpace(parts[0]),
+				params: map[string]string{},
+			}
+			for _, param := range parts[1:] {
+				kv := strings.SplitN(param, "=", 2)
+				value := ""
+				if len(kv) == 2 {
+					value = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+				}
+				offer.params[strings.TrimSpace(kv[0])] = value
+			}
+			if offer.name != "" {
+				offers = append(offers, offer)
+			}
+		}
+	}
+	return offers
+}
+
+func parseWindowBits(v string) (int, bool) {
+	bits, err := strconv.Atoi(v)
+	return bits, err == nil && bits >= 8 && bits <= 15
+}
+
+//accept returns the parameters a server answers to the client
+//offers, or false if none can be accepted.
+func (c *WebSocketCompression) accept(offers []extensionOffer) (deflateParams, bool) {
+next:
+	for _, offer := range offers {
+		if offer.name != "permessage-deflate" {
+			continue
+		}
+		p := deflateParams{
+			serverNoContextTakeover: c.ServerNoContextTakeover,
+			clientNoContextTakeover: c.ClientNoContextTakeover,
+		}
+		for name, value := range offer.params {
+			switch name {
+			case "server_no_context_takeover":
+				if value != "" {
+					continue next
+				}
+				p.serverNoContextTakeover = true
+			case "client_no_context_takeover":
+				if value != "" {
+					continue next
+				}
+				p.clientNoContextTakeover = true
+			case "server_max_window_bits":
+				if bits, ok := parseWindowBits(value); !ok || bits < 15 {
+					continue next // we can't compress with a smaller window
+				}
+			case "client_max_window_bits":
+				if value != "" {
+					if _, ok := parseWindowBits(value); !ok {
+						continue next
+					}
+				}
+				// client supports the parameter
+				if c.ClientMaxWindowBits != 0 {
+					p.clientMaxWindowBits = c.ClientMaxWindowBits
+				}
+			default:
+				continue next
+			}
+		}
+		return p, true
+	}
+	return deflateParams{}, false
+}
+
+//offer returns the extension offer of a client.
+func (c *WebSocketCompression) offer() string {
+	return deflateParams{
+		serverNoContextTakeover: c.ServerNoContextTakeover,
+		clientNoContextTakeover: c.ClientNoContextTakeover,
+		serverMaxWindowBits:     c.ServerMaxWindowBits,
+	}.String()
+}
+
+//accepted validates the parameters a server answered.
+func (c *WebSocketCompression) accepted(h http.Header) (*deflateParams, error) {
+	offers := parseExtensions(h)
+	if len(offers) == 0 {
+		return nil, nil
+	}
+	if len(offers) > 1 || offers[0].name != "permessage-deflate" {
+		return nil, errors.New("socketman: websocket handshake: unexpected extensions")
+	}
+	p := &deflateParams{clientNoContextTakeover: c.ClientNoContextTakeover}
+	for name, value := range offers[0].params {
+		switch name {
+		case "server_no_context_takeover":
+			p.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			p.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			bits, ok := parseWindowBits(value)
+			if !ok || (c.ServerMaxWindowBits != 0 && bits > c.ServerMaxWindowBits) {
+				return nil, fmt.Errorf("socketman: websocket handshake: invalid server_max_window_bits %q", value)
+			}
+			p.serverMaxWindowBits = bits
+		default:
+			// client_max_window_bits was not offered: we can't comply.
+			return nil, fmt.Errorf("socketman: websocket handshake: unexpected permessage-deflate parameter %s", name)
+		}
+	}
+	if c.ServerNoContextTakeover && !p.serverNoContextTakeover {
+		return nil, errors.New("socketman: websocket handshake: server refused server_no_context_takeover")
+	}
+	return p, nil
+}
+
+//deflateTail ends a compressed message, see RFC 7692 section 7.2.1.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+//deflateFinal is appended to received messages, an empty final block,
+//so decompression reaches io.EOF.
+var deflateFinal = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+//wsDeflate compresses and decompresses messages of a connection.
+type wsDeflate struct {
+	threshold int
+
+	level      int
+	takeover   bool // compression context is kept between messages
+	compressed bytes.Buffer
+	fw         *flate.Writer
+
+	readTakeover bool // decompression context is kept between messages
+	fr           io.ReadCloser
+	dict         []byte // last 32KB decompressed, when readTakeover
+}
+
+func newWSDeflate(p deflateParams, server bool, config *WebSocketCompression) *wsDeflate {
+	d := &wsDeflate{
+		threshold: config.Threshold,
+		level:     config.Level,
+	}
+	if d.level == 0 {
+		d.level = flate.DefaultCompression
+	}
+	if server {
+		d.takeover = !p.serverNoContextTakeover
+		d.readTakeover = !p.clientNoContextTakeover
+	} else {
+		d.takeover = !p.clientNoContextTakeover
+		d.readTakeover = !p.serverNoContextTakeover
+	}
+	return d
+}
+
+//compress compresses p. The result is only valid until the next call.
+func (d *wsDeflate) compress(p []byte) ([]byte, error) {
+	d.compressed.Reset()
+	if d.fw == nil {
+		fw, err := flate.NewWriter(&d.compressed, d.level)
+		if err != nil {
+			return nil, err
+		}
+		d.fw = fw
+	} else if !d.takeover {
+		d.fw.Reset(&d.compressed)
+	}
+	if _, err := d.fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := d.fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(d.compressed.Bytes(), deflateTail), nil
+}
+
+//decompress decompresses p, failing if it inflates
+//to more than max bytes.
+func (d *wsDeflate) decompress(p []byte, max int) ([]byte, error) {
+	r := io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateFinal))
+	if d.fr == nil {
+		d.fr = flate.NewReaderDict(r, d.dict)
+	} else {
+		d.fr.(flate.Resetter).Reset(r, d.dict)
+	}
+	out, err := io.ReadAll(io.LimitReader(d.fr, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > max {
+		return nil, errMessageTooBig
+	}
+	if d.readTakeover {
+		d.dict = append(d.dict, out...)
+		if len(d.dict) > 32<<10 {
+			d.dict = append(d.dict[:0], d.dict[len(d.dict)-32<<10:]...)
+		}
+	}
+	return out, nil
+}
+
+var errMessageTooBig = errors.New("message too big")
@@ -0,0 +1,170 @@
+package socketman_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/azr/socketman"
+)
+
+// deflate compresses p the way permessage-deflate does.
+func deflate(p []byte) []byte {
+	buf := &bytes.Buffer{}
+	w, _ := flate.NewWriter(buf, flate.BestCompression)
+	w.Write(p)
+	w.Flush()
+	return bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff})
+}
+
+func TestWebSocket_compression(t *testing.T) {
+	messages := [][]byte{
+		[]byte("tiny"),
+		bytes.Repeat([]byte("compressible "), 1000),
+		bytes.Repeat([]byte("compressible "), 1000), // reuses the context
+		{},
+		[]byte(strings.Repeat("fragmented ", 100)),
+	}
+
+	for _, c := range []struct {
+		desc           string
+		server, client *socketman.WebSocketCompression
+		compressed     bool
+	}{
+		{"default", &socketman.WebSocketCompression{}, &socketman.WebSocketCompression{}, true},
+		{"no context takeover",
+			&socketman.WebSocketCompression{ClientNoContextTakeover: true},
+			&socketman.WebSocketCompression{ServerNoContextTakeover: true, Level: flate.BestSpeed},
+			true},
+		{"threshold and window bits",
+			&socketman.WebSocketCompression{Threshold: 100, ClientMaxWindowBits: 10},
+			&socketman.WebSocketCompression{Threshold: 100, ServerMaxWindowBits: 15},
+			true},
+		{"server only", &socketman.WebSocketCompression{}, nil, false},
+		{"client only", nil, &socketman.WebSocketCompression{}, false},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			server := &socketman.Server{
+				Config: socketman.Config{
+					WebSocket: &socketman.WebSocketConfig{Compression: c.server},
+				},
+			}
+			client := &socketman.Client{
+				Config: socketman.Config{
+					WebSocket: &socketman.WebSocketConfig{Compression: c.client, FragmentSize: 64},
+				},
+			}
+			testAt(t, addr, server, wsEchoHandler, "ws://"+addr, client, func(rw io.ReadWriter) {
+				ws, _ := socketman.WebSocket(rw)
+				if ws.Compressed() != c.compressed {
+					t.Errorf("expected compressed %t, got %t", c.compressed, ws.Compressed())
+				}
+				for _, msg := range messages {
+					if err := ws.WriteMessage(socketman.TextMessage, msg); err != nil {
+						t.Errorf("write failed: %s", err)
+						return
+					}
+					typ, p, err := ws.ReadMessage()
+					if err != nil || typ != socketman.TextMessage || !bytes.Equal(p, msg) {
+						t.Errorf("expected text echo of %d bytes, got %d %d bytes %v", len(msg), typ, len(p), err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestWebSocket_compressionNegotiation(t *testing.T) {
+	stop := startWSServer(t, &socketman.WebSocketConfig{
+		MaxMessageSize: 1024,
+		Compression:    &socketman.WebSocketCompression{Threshold: 1024, ClientMaxWindowBits: 10},
+	})
+	defer stop()
+
+	for _, c := range []struct {
+		desc     string
+		offer    string
+		accepted string
+	}{
+		{"none", "", ""},
+		{"unknown extension", "x-webkit-deflate-frame", ""},
+		{"default", "permessage-deflate", "permessage-deflate"},
+		{"client window bits", "permessage-deflate; client_max_window_bits",
+			"permessage-deflate; client_max_window_bits=10"},
+		{"small server window declined", "permessage-deflate; server_max_window_bits=10", ""},
+		{"fallback offer", "permessage-deflate; server_max_window_bits=10, permessage-deflate; server_no_context_takeover",
+			"permessage-deflate; server_no_context_takeover"},
+		{"unknown parameter", "permessage-deflate; foo=bar", ""},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			var h http.Header
+			if c.offer != "" {
+				h = http.Header{"Sec-Websocket-Extensions": {c.offer}}
+			}
+			ws, resp := dialRawWS(t, "/", h)
+			defer ws.c.Close()
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("handshake failed: %s", resp.Status)
+			}
+			if got := resp.Header.Get("Sec-Websocket-Extensions"); got != c.accepted {
+				t.Fatalf("expected extensions %q, got %q", c.accepted, got)
+			}
+		})
+	}
+
+	offer := http.Header{"Sec-Websocket-Extensions": {"permessage-deflate"}}
+	t.Run("compressed message", func(t *testing.T) {
+		ws, _ := dialRawWS(t, "/", offer)
+		defer ws.c.Close()
+		// RFC 7692 section 7.2.3.1 example
+		ws.send(true, 4, socketman.TextMessage, []byte{0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00})
+		ws.expect(socketman.TextMessage, []byte("Hello"))
+		// fragmented, RSV1 on the first frame only
+		p := deflate([]byte("Hello, fragments"))
+		ws.send(false, 4, socketman.TextMessage, p[:3])
+		ws.send(true, 0, 0, p[3:])
+		ws.expect(socketman.TextMessage, []byte("Hello, fragments"))
+		ws.send(true, 0, socketman.TextMessage, []byte("uncompressed"))
+		ws.expect(socketman.TextMessage, []byte("uncompressed"))
+	})
+	t.Run("rsv1 on continuation", func(t *testing.T) {
+		ws, _ := dialRawWS(t, "/", offer)
+		defer ws.c.Close()
+		p := deflate([]byte("Hello"))
+		ws.send(false, 4, socketman.TextMessage, p[:3])
+		ws.send(true, 4, 0, p[3:])
+		ws.expectClose(socketman.CloseProtocolError)
+	})
+	t.Run("rsv1 on control frame", func(t *testing.T) {
+		ws, _ := dialRawWS(t, "/", offer)
+		defer ws.c.Close()
+		ws.send(true, 4, socketman.PingMessage, nil)
+		ws.expectClose(socketman.CloseProtocolError)
+	})
+	t.Run("rsv1 not negotiated", func(t *testing.T) {
+		ws, _ := dialRawWS(t, "/", nil)
+		defer ws.c.Close()
+		ws.send(true, 4, socketman.TextMessage, deflate([]byte("Hello")))
+		ws.expectClose(socketman.CloseProtocolError)
+	})
+	t.Run("decompression bomb", func(t *testing.T) {
+		ws, _ := dialRawWS(t, "/", offer)
+		defer ws.c.Close()
+		p := deflate(make([]byte, 256<<10))
+		if len(p) > 1024 {
+			t.Fatalf("compressed bomb should fit the message size limit, got %d bytes", len(p))
+		}
+		ws.send(true, 4, socketman.BinaryMessage, p)
+		ws.expectClose(socketman.CloseMessageTooBig)
+	})
+	t.Run("invalid compressed data", func(t *testing.T) {
+		ws, _ := dialRawWS(t, "/", offer)
+		defer ws.c.Close()
+		ws.send(true, 4, socketman.BinaryMessage, []byte{0xff, 0xff, 0xff})
+		ws.expectClose(socketman.CloseInvalidPayload)
+	})
+}
@@ -0,0 +1,313 @@
+package socketman
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//websocketGUID is appended to the key of a handshake, see RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+//WebSocketConfig configures websocket connections.
+//
+//A Server with a WebSocketConfig expects each connection to start
+//with a websocket handshake. A Client talks websocket when dialing
+//"ws://" or "wss://" urls, using its WebSocketConfig if any.
+type WebSocketConfig struct {
+	//Path is the request path a server accepts handshakes on.
+	//Empty means any path.
+	Path string
+
+	//CheckOrigin, if set, is called by a server to accept
+	//or refuse a handshake request.
+	CheckOrigin func(r *http.Request) bool
+
+	//Origin is sent by clients in handshake requests.
+	Origin string
+
+	//Header holds extra headers sent by clients
+	//in handshake requests.
+	Header http.Header
+
+	//Subprotocols lists supported subprotocols, by order of
+	//preference for a server.
+	Subprotocols []string
+
+	//MessageType is the type of messages sent by Write,
+	//BinaryMessage if zero.
+	MessageType int
+
+	//MaxMessageSize is the maximum size of a received message.
+	//Zero means DefaultMaxMessageSize.
+	MaxMessageSize int
+
+	//FragmentSize, if non zero, splits sent data messages into
+	//frames of at most FragmentSize bytes.
+	FragmentSize int
+
+	//Compression, if set, enables permessage-deflate.
+	Compression *WebSocketCompression
+}
+
+func (c *WebSocketConfig) maxMessageSize() int {
+	if c.MaxMessageSize > 0 {
+		return c.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+//headerContains tells whether the comma separated
+//header values contain token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//handshakeError is a refused handshake request.
+type handshakeError struct {
+	status int
+	header http.Header
+	reason string
+}
+
+func (e *handshakeError) Error() string {
+	return "socketman: websocket handshake: " + e.reason
+}
+
+//checkRequest validates a websocket handshake request and returns
+//the response headers accepting it, with the negotiated
+//permessage-deflate parameters if any.
+func (c *WebSocketConfig) checkRequest(r *http.Request) (http.Header, *deflateParams, error) {
+	if r.Method != "GET" || !r.ProtoAtLeast(1, 1) {
+		return nil, nil, &handshakeError{status: http.StatusMethodNotAllowed, reason: "not an HTTP/1.1 GET request"}
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return nil, nil, &handshakeError{status: http.StatusBadRequest, reason: "not a websocket upgrade request"}
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		return nil, nil, &handshakeError{
+			status: http.StatusUpgradeRequired,
+			header: http.Header{"Sec-Websocket-Version": {"13"}},
+			reason: "unsupported version " + r.Header.Get("Sec-Websocket-Version"),
+		}
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if k, err := base64.StdEncoding.DecodeString(key); err != nil || len(k) != 16 {
+		return nil, nil, &handshakeError{status: http.StatusBadRequest, reason: "invalid key"}
+	}
+	if c.Path != "" && r.URL.Path != c.Path {
+		return nil, nil, &handshakeError{status: http.StatusNotFound, reason: "unknown path " + r.URL.Path}
+	}
+	if c.CheckOrigin != nil && !c.CheckOrigin(r) {
+		return nil, nil, &handshakeError{status: http.StatusForbidden, reason: "origin refused"}
+	}
+
+	h := http.Header{
+		"Upgrade":              {"websocket"},
+		"Connection":           {"Upgrade"},
+		"Sec-Websocket-Accept": {webSocketAccept(key)},
+	}
+	if p := c.selectSubprotocol(r); p != "" {
+		h.Set("Sec-Websocket-Protocol", p)
+	}
+	var deflate *deflateParams
+	if c.Compression != nil {
+		if p, ok := c.Compression.accept(parseExtensions(r.Header)); ok {
+			deflate = &p
+			h.Set("Sec-Websocket-Extensions", p.String())
+		}
+	}
+	return h, deflate, nil
+}
+
+func (c *WebSocketConfig) selectSubprotocol(r *http.Request) string {
+	for _, supported := range c.Subprotocols {
+		if headerContains(r.Header, "Sec-Websocket-Protocol", supported) {
+			return supported
+		}
+	}
+	return ""
+}
+
+//writeResponse writes an HTTP/1.1 response without body.
+func writeResponse(w io.Writer, status int, h http.Header) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	h.Write(bw)
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+//serverHandshake reads a handshake request on con and answers it.
+func (c *WebSocketConfig) serverHandshake(con net.Conn) (*WebSocketConn, error) {
+	br := bufio.NewReader(con)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+	h, deflate, err := c.checkRequest(req)
+	if err != nil {
+		herr := err.(*handshakeError)
+		if herr.header == nil {
+			herr.header = http.Header{}
+		}
+		herr.header.Set("Connection", "close")
+		writeResponse(con, herr.status, herr.header)
+		return nil, err
+	}
+	if err := writeResponse(con, http.StatusSwitchingProtocols, h); err != nil {
+		return nil, err
+	}
+	return newWebSocketConn(con, br, true, *c, h.Get("Sec-Websocket-Protocol"), deflate), nil
+}
+
+//clientHandshake sends a handshake request for u on con.
+func (c *WebSocketConfig) clientHandshake(con net.Conn, u *url.URL) (*WebSocketConn, error) {
+	var k [16]byte
+	if _, err := io.ReadFull(rand.Reader, k[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(k[:])
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-Websocket-Key", key)
+	req.Header.Set("Sec-Websocket-Version", "13")
+	if c.Origin != "" {
+		req.Header.Set("Origin", c.Origin)
+	}
+	if len(c.Subprotocols) > 0 {
+		req.Header.Set("Sec-Websocket-Protocol", strings.Join(c.Subprotocols, ", "))
+	}
+	if c.Compression != nil {
+		req.Header.Set("Sec-Websocket-Extensions", c.Compression.offer())
+	}
+	if err := req.Write(con); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(con)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, &handshakeError{status: resp.StatusCode, reason: "server answered " + resp.Status}
+	}
+	if !headerContains(resp.Header, "Connection", "upgrade") || !headerContains(resp.Header, "Upgrade", "websocket") {
+		return nil, errors.New("socketman: websocket handshake: server did not upgrade")
+	}
+	if resp.Header.Get("Sec-Websocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("socketman: websocket handshake: invalid accept key")
+	}
+	subprotocol := resp.Header.Get("Sec-Websocket-Protocol")
+	if subprotocol != "" && !contains(c.Subprotocols, subprotocol) {
+		return nil, errors.New("socketman: websocket handshake: unexpected subprotocol " + subprotocol)
+	}
+	var deflate *deflateParams
+	if c.Compression != nil {
+		deflate, err = c.Compression.accepted(resp.Header)
+		if err != nil {
+			return nil, err
+		}
+	} else if resp.Header.Get("Sec-Websocket-Extensions") != "" {
+		return nil, errors.New("socketman: websocket handshake: unexpected extensions")
+	}
+	return newWebSocketConn(con, br, false, *c, subprotocol, deflate), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+//webSocketURL parses addr if it's a websocket url.
+func webSocketURL(addr string) (*url.URL, bool) {
+	if !strings.HasPrefix(addr, "ws://") && !strings.HasPrefix(addr, "wss://") {
+		return nil, false
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, false
+	}
+	return u, true
+}
+
+//dialWebSocket connects to the websocket url u.
+func (c *Client) dialWebSocket(u *url.URL) (net.Conn, error) {
+	con, err := c.dialURL(u, u.Scheme == "wss")
+	if err != nil {
+		return nil, err
+	}
+	config := c.Config.WebSocket
+	if config == nil {
+		config = &WebSocketConfig{}
+	}
+	ws, err := config.clientHandshake(con, u)
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+//dialURL connects to the host of u, using the default
+//http or https port if u has none.
+//Secure connections use TLSConfig, or a default config.
+func (c *Client) dialURL(u *url.URL, secure bool) (net.Conn, error) {
+	hostport := u.Host
+	var tlsConfig *tls.Config
+	if secure {
+		tlsConfig = c.Config.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if u.Port() == "" {
+			hostport = net.JoinHostPort(u.Hostname(), "443")
+		}
+	} else if u.Port() == "" {
+		hostport = net.JoinHostPort(u.Hostname(), "80")
+	}
+	return c.dial(hostport, tlsConfig)
+}
@@ -0,0 +1,522 @@
+package socketman_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/azr/socketman"
+	"github.com/azr/socketman/internal"
+)
+
+const wsMaxMessageSize = 1 << 17
+
+// wsEchoHandler echoes websocket messages keeping their type.
+func wsEchoHandler(c io.ReadWriter) {
+	ws, ok := socketman.WebSocket(c)
+	if !ok {
+		panic("not a websocket connection")
+	}
+	for {
+		typ, p, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := ws.WriteMessage(typ, p); err != nil {
+			return
+		}
+	}
+}
+
+// startWSServer starts a websocket echo server on addr.
+func startWSServer(t *testing.T, config *socketman.WebSocketConfig) func() {
+	server := &socketman.Server{
+		Config: socketman.Config{WebSocket: config},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.ListenAndServeFunc(addr, wsEchoHandler)
+	}()
+	time.Sleep(time.Millisecond)
+	return func() {
+		server.Close()
+		<-done
+	}
+}
+
+// rawWS is a websocket client speaking frames, to check a server
+// behaves.
+type rawWS struct {
+	t  *testing.T
+	c  net.Conn
+	br *bufio.Reader
+}
+
+func wsRequest(path string, header http.Header) string {
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	h := http.Header{
+		"Upgrade":               {"websocket"},
+		"Connection":            {"Upgrade"},
+		"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+		"Sec-Websocket-Version": {"13"},
+	}
+	for k, v := range header {
+		if v == nil {
+			delete(h, k)
+		} else {
+			h[k] = v
+		}
+	}
+	buf := &bytes.Buffer{}
+	h.Write(buf)
+	return req + buf.String() + "\r\n"
+}
+
+// dialRawWS sends a handshake request and returns the response.
+func dialRawWS(t *testing.T, path string, header http.Header) (*rawWS, *http.Response) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	ws := &rawWS{t: t, c: c, br: bufio.NewReader(c)}
+	io.WriteString(c, wsRequest(path, header))
+	resp, err := http.ReadResponse(ws.br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws, resp
+}
+
+func (ws *rawWS) send(fin bool, rsv, opcode byte, payload []byte) {
+	ws.sendFrame(fin, rsv, opcode, payload, true)
+}
+
+func (ws *rawWS) sendFrame(fin bool, rsv, opcode byte, payload []byte, masked bool) {
+	b := []byte{opcode | rsv<<4, 0}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch l := len(payload); {
+	case l <= 125:
+		b[1] = byte(l)
+	case l <= 0xffff:
+		b[1] = 126
+		b = binary.BigEndian.AppendUint16(b, uint16(l))
+	default:
+		b[1] = 127
+		b = binary.BigEndian.AppendUint64(b, uint64(l))
+	}
+	p := append([]byte{}, payload...)
+	if masked {
+		b[1] |= 0x80
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		b = append(b, mask...)
+		for i := range p {
+			p[i] ^= mask[i%4]
+		}
+	}
+	ws.c.Write(append(b, p...))
+}
+
+func (ws *rawWS) recv() (fin bool, opcode byte, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(ws.br, h[:]); err != nil {
+		return
+	}
+	fin = h[0]&0x80 != 0
+	opcode = h[0] & 0xf
+	if h[1]&0x80 != 0 {
+		ws.t.Errorf("server sent a masked frame")
+	}
+	l := uint64(h[1] & 0x7f)
+	switch l {
+	case 126:
+		var b [2]byte
+		io.ReadFull(ws.br, b[:])
+		l = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		io.ReadFull(ws.br, b[:])
+		l = binary.BigEndian.Uint64(b[:])
+	}
+	payload = make([]byte, l)
+	_, err = io.ReadFull(ws.br, payload)
+	return
+}
+
+// expect checks the next frame.
+func (ws *rawWS) expect(opcode byte, payload []byte) {
+	ws.t.Helper()
+	fin, op, p, err := ws.recv()
+	if err != nil {
+		ws.t.Fatalf("expected frame %d, got error %s", opcode, err)
+	}
+	if !fin || op != opcode || !bytes.Equal(p, payload) {
+		ws.t.Fatalf("expected final frame %d with %d bytes, got frame %d (fin: %t) with %d bytes: %q",
+			opcode, len(payload), op, fin, len(p), truncate(p))
+	}
+}
+
+// expectClose checks the server sends a close frame with code
+// and hangs up. A zero code expects an empty close frame.
+func (ws *rawWS) expectClose(code int) {
+	ws.t.Helper()
+	_, op, p, err := ws.recv()
+	if err != nil {
+		ws.t.Fatalf("expected close %d, got error %s", code, err)
+	}
+	if op != socketman.CloseMessage {
+		ws.t.Fatalf("expected close %d, got frame %d: %q", code, op, truncate(p))
+	}
+	got := 0
+	if len(p) >= 2 {
+		got = int(binary.BigEndian.Uint16(p))
+	}
+	if got != code {
+		ws.t.Fatalf("expected close %d, got close %d: %q", code, got, p)
+	}
+	// the server may hang up with unread data: EOF or reset.
+	if _, op, _, err := ws.recv(); err == nil {
+		ws.t.Fatalf("expected server to hang up, got frame %d", op)
+	}
+}
+
+func truncate(p []byte) []byte {
+	if len(p) > 32 {
+		return p[:32]
+	}
+	return p
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+type wsCase struct {
+	id   string
+	desc string
+	run  func(ws *rawWS)
+}
+
+// wsCases mimics sections of the autobahn test suite.
+var wsCases []wsCase
+
+func init() {
+	add := func(id, desc string, run func(ws *rawWS)) {
+		wsCases = append(wsCases, wsCase{id, desc, run})
+	}
+
+	// 1: framing
+	for i, l := range []int{0, 125, 126, 127, 65535, 65536} {
+		l := l
+		add(fmt.Sprintf("1.1.%d", i+1), fmt.Sprintf("text message of %d bytes", l), func(ws *rawWS) {
+			p := bytes.Repeat([]byte("*"), l)
+			ws.send(true, 0, socketman.TextMessage, p)
+			ws.expect(socketman.TextMessage, p)
+		})
+		add(fmt.Sprintf("1.2.%d", i+1), fmt.Sprintf("binary message of %d bytes", l), func(ws *rawWS) {
+			p := bytes.Repeat([]byte{0xfe}, l)
+			ws.send(true, 0, socketman.BinaryMessage, p)
+			ws.expect(socketman.BinaryMessage, p)
+		})
+	}
+
+	// 2: pings and pongs
+	add("2.1", "ping without payload", func(ws *rawWS) {
+		ws.send(true, 0, socketman.PingMessage, nil)
+		ws.expect(socketman.PongMessage, []byte{})
+	})
+	add("2.2", "ping with 125 bytes payload", func(ws *rawWS) {
+		p := bytes.Repeat([]byte{0xfe}, 125)
+		ws.send(true, 0, socketman.PingMessage, p)
+		ws.expect(socketman.PongMessage, p)
+	})
+	add("2.3", "ping with 126 bytes payload", func(ws *rawWS) {
+		ws.send(true, 0, socketman.PingMessage, bytes.Repeat([]byte{0xfe}, 126))
+		ws.expectClose(socketman.CloseProtocolError)
+	})
+	add("2.4", "unsolicited pong is ignored", func(ws *rawWS) {
+		ws.send(true, 0, socketman.PongMessage, []byte("unsolicited"))
+		ws.send(true, 0, socketman.PingMessage, []byte("ping"))
+		ws.expect(socketman.PongMessage, []byte("ping"))
+	})
+	add("2.5", "ten pings", func(ws *rawWS) {
+		for i := 0; i < 10; i++ {
+			ws.send(true, 0, socketman.PingMessage, []byte{byte(i)})
+		}
+		for i := 0; i < 10; i++ {
+			ws.expect(socketman.PongMessage, []byte{byte(i)})
+		}
+	})
+
+	// 3: reserved bits
+	for i, rsv := range []byte{1, 2, 4, 7} {
+		rsv := rsv
+		add(fmt.Sprintf("3.%d", i+1), fmt.Sprintf("reserved bits %03b set", rsv), func(ws *rawWS) {
+			ws.send(true, rsv, socketman.TextMessage, []byte("hello"))
+			ws.expectClose(socketman.CloseProtocolError)
+		})
+	}
+
+	// 4: opcodes
+	for i, op := range []byte{3, 4, 5, 6, 7, 11, 12, 13, 14, 15} {
+		op := op
+		add(fmt.Sprintf("4.%d", i+1), fmt.Sprintf("reserved opcode %d", op), func(ws *rawWS) {
+			ws.send(true, 0, op, nil)
+			ws.expectClose(socketman.CloseProtocolError)
+		})
+	}
+
+	// 5: fragmentation
+	add("5.1", "fragmented ping", func(ws *rawWS) {
+		ws.send(false, 0, socketman.PingMessage, []byte("frag"))
+		ws.send(true, 0, 0, []byte("ment"))
+		ws.expectClose(socketman.CloseProtocolError)
+	})
+	add("5.2", "text message in two fragments", func(ws *rawWS) {
+		ws.send(false, 0, socketman.TextMessage, []byte("frag"))
+		ws.send(true, 0, 0, []byte("ment"))
+		ws.expect(socketman.TextMessage, []byte("fragment"))
+	})
+	add("5.3", "ping between fragments", func(ws *rawWS) {
+		ws.send(false, 0, socketman.BinaryMessage, []byte("fr"))
+		ws.send(true, 0, socketman.PingMessage, []byte("ping"))
+		ws.send(false, 0, 0, []byte("agm"))
+		ws.send(true, 0, 0, []byte("ent"))
+		ws.expect(socketman.PongMessage, []byte("ping"))
+		ws.expect(socketman.BinaryMessage, []byte("fragment"))
+	})
+	add("5.4", "continuation without message", func(ws *rawWS) {
+		ws.send(true, 0, 0, []byte("orphan"))
+		ws.expectClose(socketman.CloseProtocolError)
+	})
+	add("5.5", "new message before final fragment", func(ws *rawWS) {
+		ws.send(false, 0, socketman.TextMessage, []byte("frag"))
+		ws.send(true, 0, socketman.TextMessage, []byte("ment"))
+		ws.expectClose(socketman.CloseProtocolError)
+	})
+	add("5.6", "empty fragments", func(ws *rawWS) {
+		ws.send(false, 0, socketman.TextMessage, nil)
+		ws.send(false, 0, 0, nil)
+		ws.send(true, 0, 0, nil)
+		ws.expect(socketman.TextMessage, []byte{})
+	})
+
+	// 6: utf-8
+	hello := []byte("κόσμε")
+	add("6.1", "valid utf-8 split within a character", func(ws *rawWS) {
+		ws.send(false, 0, socketman.TextMessage, hello[:1])
+		ws.send(true, 0, 0, hello[1:])
+		ws.expect(socketman.TextMessage, hello)
+	})
+	add("6.2", "invalid utf-8", func(ws *rawWS) {
+		ws.send(true, 0, socketman.TextMessage, []byte{0xce, 0xba, 0xe1, 0xbd, 0xb9, 0xcf, 0x83, 0xce, 0xbc, 0xce, 0xb5, 0xed, 0xa0, 0x80})
+		ws.expectClose(socketman.CloseInvalidPayload)
+	})
+	add("6.3", "truncated utf-8 sequence", func(ws *rawWS) {
+		ws.send(true, 0, socketman.TextMessage, hello[:len(hello)-1])
+		ws.expectClose(socketman.CloseInvalidPayload)
+	})
+	add("6.4", "invalid utf-8 is fine in binary messages", func(ws *rawWS) {
+		ws.send(true, 0, socketman.BinaryMessage, []byte{0xff, 0xfe})
+		ws.expect(socketman.BinaryMessage, []byte{0xff, 0xfe})
+	})
+
+	// 7: closing
+	add("7.1", "normal close", func(ws *rawWS) {
+		ws.send(true, 0, socketman.CloseMessage, closePayload(1000, "bye"))
+		ws.expectClose(1000)
+	})
+	add("7.2", "empty close", func(ws *rawWS) {
+		ws.send(true, 0, socketman.CloseMessage, nil)
+		ws.expectClose(0)
+	})
+	add("7.3", "close with one byte payload", func(ws *rawWS) {
+		ws.send(true, 0, socketman.CloseMessage, []byte{0x03})
+		ws.expectClose(socketman.CloseProtocolError)
+	})
+	for i, code := range []int{0, 999, 1004, 1005, 1006, 1012, 1015, 1016, 2999, 5000, 65535} {
+		code := code
+		add(fmt.Sprintf("7.4.%d", i+1), fmt.Sprintf("invalid close code %d", code), func(ws *rawWS) {
+			ws.send(true, 0, socketman.CloseMessage, closePayload(code, ""))
+			ws.expectClose(socketman.CloseProtocolError)
+		})
+	}
+	for i, code := range []int{1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999} {
+		code := code
+		add(fmt.Sprintf("7.5.%d", i+1), fmt.Sprintf("valid close code %d", code), func(ws *rawWS) {
+			ws.send(true, 0, socketman.CloseMessage, closePayload(code, ""))
+			ws.expectClose(code)
+		})
+	}
+	add("7.6", "invalid utf-8 close reason", func(ws *rawWS) {
+		ws.send(true, 0, socketman.CloseMessage, closePayload(1000, "\xff"))
+		ws.expectClose(socketman.CloseInvalidPayload)
+	})
+	add("7.7", "messages after close are ignored", func(ws *rawWS) {
+		ws.send(true, 0, socketman.CloseMessage, closePayload(1000, ""))
+		ws.send(true, 0, socketman.TextMessage, []byte("too late"))
+		ws.expectClose(1000)
+	})
+
+	// 9: limits
+	add("9.1", "message too big", func(ws *rawWS) {
+		ws.send(true, 0, socketman.BinaryMessage, make([]byte, wsMaxMessageSize+1))
+		ws.expectClose(socketman.CloseMessageTooBig)
+	})
+	add("9.2", "fragmented message too big", func(ws *rawWS) {
+		ws.send(false, 0, socketman.BinaryMessage, make([]byte, wsMaxMessageSize))
+		ws.send(true, 0, 0, make([]byte, 1))
+		ws.expectClose(socketman.CloseMessageTooBig)
+	})
+
+	// 10: misc
+	add("10.1", "unmasked client frame", func(ws *rawWS) {
+		ws.sendFrame(true, 0, socketman.TextMessage, []byte("hello"), false)
+		ws.expectClose(socketman.CloseProtocolError)
+	})
+}
+
+func TestWebSocket_conformance(t *testing.T) {
+	stop := startWSServer(t, &socketman.WebSocketConfig{MaxMessageSize: wsMaxMessageSize})
+	defer stop()
+
+	for _, c := range wsCases {
+		t.Run(c.id, func(t *testing.T) {
+			t.Log(c.desc)
+			ws, resp := dialRawWS(t, "/", nil)
+			defer ws.c.Close()
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("handshake failed: %s", resp.Status)
+			}
+			if accept := resp.Header.Get("Sec-Websocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+				t.Fatalf("invalid accept key %q", accept)
+			}
+			c.run(ws)
+		})
+	}
+}
+
+func TestWebSocket_handshake(t *testing.T) {
+	stop := startWSServer(t, &socketman.WebSocketConfig{
+		Path: "/socket",
+		CheckOrigin: func(r *http.Request) bool {
+			return r.Header.Get("Origin") != "http://evil.example.com"
+		},
+		Subprotocols: []string{"v2", "v1"},
+	})
+	defer stop()
+
+	for _, c := range []struct {
+		desc   string
+		path   string
+		header http.Header
+		status int
+	}{
+		{"accepted", "/socket", nil, http.StatusSwitchingProtocols},
+		{"no upgrade", "/socket", http.Header{"Upgrade": nil}, http.StatusBadRequest},
+		{"no key", "/socket", http.Header{"Sec-Websocket-Key": nil}, http.StatusBadRequest},
+		{"bad key", "/socket", http.Header{"Sec-Websocket-Key": {"c2hvcnQ="}}, http.StatusBadRequest},
+		{"old version", "/socket", http.Header{"Sec-Websocket-Version": {"8"}}, http.StatusUpgradeRequired},
+		{"unknown path", "/other", nil, http.StatusNotFound},
+		{"refused origin", "/socket", http.Header{"Origin": {"http://evil.example.com"}}, http.StatusForbidden},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			ws, resp := dialRawWS(t, c.path, c.header)
+			defer ws.c.Close()
+			if resp.StatusCode != c.status {
+				t.Fatalf("expected status %d, got %s", c.status, resp.Status)
+			}
+			if c.status == http.StatusUpgradeRequired && resp.Header.Get("Sec-Websocket-Version") != "13" {
+				t.Fatalf("server should tell which version it supports")
+			}
+		})
+	}
+
+	t.Run("subprotocol", func(t *testing.T) {
+		ws, resp := dialRawWS(t, "/socket", http.Header{"Sec-Websocket-Protocol": {"v1, v2"}})
+		defer ws.c.Close()
+		if p := resp.Header.Get("Sec-Websocket-Protocol"); p != "v2" {
+			t.Fatalf("expected server preferred subprotocol v2, got %q", p)
+		}
+	})
+}
+
+func TestWebSocket_client(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &socketman.Server{
+		Config: socketman.Config{
+			WebSocket: &socketman.WebSocketConfig{Path: "/echo"},
+		},
+	}
+	testEchoServerAt(t, addr, server, "ws://"+addr+"/echo", &socketman.Client{})
+	testEchoClientAt(t, addr, server, "ws://"+addr+"/echo", &socketman.Client{})
+
+	server.Config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.Config.CypherPool = aespool
+	client := &socketman.Client{
+		Config: socketman.Config{
+			TLSConfig:  &tls.Config{InsecureSkipVerify: true},
+			CypherPool: aespool,
+		},
+	}
+	testEchoServerAt(t, addr, server, "wss://"+addr+"/echo", client)
+
+	if err := client.ConnectFunc("wss://"+addr+"/echo", echoHandler); err == nil {
+		t.Fatal("connecting without server should fail")
+	}
+}
+
+func TestWebSocket_messages(t *testing.T) {
+	server := &socketman.Server{
+		Config: socketman.Config{
+			WebSocket: &socketman.WebSocketConfig{},
+		},
+	}
+	client := &socketman.Client{
+		Config: socketman.Config{
+			WebSocket: &socketman.WebSocketConfig{
+				FragmentSize: 10,
+				Subprotocols: []string{"echo"},
+			},
+		},
+	}
+	text := strings.Repeat("fragmented ", 10)
+	testAt(t, addr, server, wsEchoHandler, "ws://"+addr, client, func(c io.ReadWriter) {
+		ws, ok := socketman.WebSocket(c)
+		if !ok {
+			t.Error("client connection should be a websocket")
+			return
+		}
+		if err := ws.WriteMessage(socketman.TextMessage, []byte(text)); err != nil {
+			t.Errorf("write failed: %s", err)
+			return
+		}
+		typ, p, err := ws.ReadMessage()
+		if err != nil || typ != socketman.TextMessage || string(p) != text {
+			t.Errorf("expected text echo, got %d %q %v", typ, p, err)
+		}
+		if ws.Subprotocol() != "" {
+			t.Errorf("server does not support any subprotocol, got %q", ws.Subprotocol())
+		}
+		if err := ws.WriteMessage(socketman.PingMessage, make([]byte, 126)); err == nil {
+			t.Errorf("too long ping should not be sent")
+		}
+	})
+}